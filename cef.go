@@ -0,0 +1,150 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var header = []string{
+	"version",
+	"vendor",
+	"product",
+	"device_version",
+	"signature",
+	"name",
+	"severity",
+}
+
+var layouts = []string{
+	time.RFC3339Nano,
+	time.DateTime,
+	time.Stamp,
+	"Jan 02 2006 15:04:05",
+	"Jan 02 2006 15:04:05.000",
+}
+
+var extension = regexp.MustCompile(`\s([A-Za-z0-9_.\[\]-]+)=`)
+
+func cef(line string) map[string]string {
+	i := strings.Index(line, "CEF:")
+
+	if i < 0 {
+		return nil // malformed
+	}
+
+	fields := split(line[i+4:], len(header)+1)
+
+	if len(fields) <= len(header) {
+		return nil // malformed
+	}
+
+	meta := extensions(fields[len(header)])
+
+	meta["format"] = "cef"
+
+	for j, key := range header {
+		meta[key] = unescape(strings.TrimSpace(fields[j]))
+	}
+
+	if prefix := strings.Fields(line[:i]); len(prefix) > 0 {
+		meta["host"] = prefix[len(prefix)-1]
+
+		if len(prefix) > 1 {
+			meta["timestamp"] = strings.Join(prefix[:len(prefix)-1], " ")
+		}
+	}
+
+	return meta
+}
+
+func split(s string, n int) []string {
+	var fields []string
+	var escaped bool
+
+	start := 0
+
+	for i := 0; i < len(s) && len(fields) < n-1; i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '|':
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(fields, s[start:])
+}
+
+func extensions(s string) map[string]string {
+	meta := make(map[string]string)
+
+	s = " " + s // match first key
+
+	idx := extension.FindAllStringSubmatchIndex(s, -1)
+
+	for i, m := range idx {
+		end := len(s)
+
+		if i+1 < len(idx) {
+			end = idx[i+1][2] - 1 // before next key
+		}
+
+		meta[s[m[2]:m[3]]] = unescape(strings.TrimSpace(s[m[1]:end]))
+	}
+
+	return meta
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(
+		`\\`, `\`,
+		`\|`, `|`,
+		`\=`, `=`,
+		`\n`, "\n",
+		`\r`, "\r",
+	).Replace(s)
+}
+
+// timestamp parses the event time, a missing year is taken from the
+// current date.
+func timestamp(meta map[string]string) (time.Time, bool) {
+	t, ok := stamp(meta)
+
+	if ok && t.Year() == 0 {
+		now := time.Now()
+
+		t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	}
+
+	return t, ok
+}
+
+// stamp parses the event time as is, syslog times have no year.
+func stamp(meta map[string]string) (time.Time, bool) {
+	for _, key := range []string{"timestamp", "rt"} {
+		v, ok := meta[key]
+
+		if !ok {
+			continue
+		}
+
+		if key == "rt" {
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.UnixMilli(ms), true // cef receipt time
+			}
+		}
+
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestCEF(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		meta map[string]string
+	}{
+		{
+			"CEF:0|Security|threatmanager|1.0|100|worm successfully stopped|10|src=10.0.0.1 dst=2.1.2.2 spt=1232",
+			map[string]string{"format": "cef", "version": "0", "vendor": "Security", "product": "threatmanager", "device_version": "1.0", "signature": "100", "name": "worm successfully stopped", "severity": "10", "src": "10.0.0.1", "dst": "2.1.2.2", "spt": "1232"},
+		},
+		{ // escaped pipes in the header and equal signs in extensions
+			`CEF:0|Fox\|Labs|Test|1.0|100|a\|b|5|msg=x\=y and z\\w cs1=two words`,
+			map[string]string{"format": "cef", "version": "0", "vendor": "Fox|Labs", "product": "Test", "device_version": "1.0", "signature": "100", "name": "a|b", "severity": "5", "msg": `x=y and z\w`, "cs1": "two words"},
+		},
+		{ // syslog prefix
+			"Sep 19 08:26:10 host CEF:0|Fox|Test|1.0|100|login|5|",
+			map[string]string{"format": "cef", "version": "0", "vendor": "Fox", "product": "Test", "device_version": "1.0", "signature": "100", "name": "login", "severity": "5", "host": "host", "timestamp": "Sep 19 08:26:10"},
+		},
+		{"no cef", nil},
+		{"CEF:0|Fox|Test|1.0|100|login|5", nil}, // no extension
+	} {
+		if meta := cef(tc.line); !maps.Equal(meta, tc.meta) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tc.line, meta, tc.meta)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	year := time.Now().Year()
+
+	for _, tc := range []struct {
+		meta map[string]string
+		want time.Time
+		ok   bool
+	}{
+		{map[string]string{"timestamp": "2024-01-02T03:04:05Z"}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), true},
+		{map[string]string{"timestamp": "Sep 19 08:26:10"}, time.Date(year, 9, 19, 8, 26, 10, 0, time.UTC), true},
+		{map[string]string{"rt": "1700000000000"}, time.UnixMilli(1700000000000), true},
+		{map[string]string{"timestamp": "1700000000"}, time.Time{}, false}, // not milliseconds
+		{map[string]string{}, time.Time{}, false},
+	} {
+		got, ok := timestamp(tc.meta)
+
+		if !got.Equal(tc.want) || ok != tc.ok {
+			t.Errorf("%v: got %v %v, want %v %v", tc.meta, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/ollama/ollama/api"
+	"github.com/philippgille/chromem-go"
+)
+
+type Chatter interface {
+	Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
+}
+
+type Embedder interface {
+	Embed(ctx context.Context, req *api.EmbedRequest) (*api.EmbedResponse, error)
+}
+
+// Client is the subset of the ollama api used by the server, *api.Client
+// satisfies it and tests can provide canned responses instead.
+type Client interface {
+	Chatter
+	Embedder
+	Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error)
+	Pull(ctx context.Context, req *api.PullRequest, fn api.PullProgressFunc) error
+	List(ctx context.Context) (*api.ListResponse, error)
+	Heartbeat(ctx context.Context) error
+}
+
+func embedding(e Embedder, model string) chromem.EmbeddingFunc {
+	return func(ctx context.Context, text string) ([]float32, error) {
+		res, err := e.Embed(ctx, &api.EmbedRequest{
+			Model: model,
+			Input: text,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(res.Embeddings) == 0 || len(res.Embeddings[0]) == 0 {
+			return nil, errors.New("no embeddings found in the response")
+		}
+
+		return normalize(res.Embeddings[0]), nil
+	}
+}
+
+func normalize(v []float32) []float32 {
+	var sum float64
+
+	for _, f := range v {
+		sum += float64(f * f)
+	}
+
+	norm := float32(math.Sqrt(sum))
+
+	if norm == 0 {
+		return v
+	}
+
+	res := make([]float32, len(v))
+
+	for i, f := range v {
+		res[i] = f / norm
+	}
+
+	return res
+}
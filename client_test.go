@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// fake answers like ollama with canned responses, embeddings are derived
+// from the input so equal texts embed equally.
+type fake struct {
+	delay  time.Duration // per embedding
+	embeds atomic.Int64
+	chats  atomic.Int64
+}
+
+func (f *fake) Chat(_ context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	f.chats.Add(1)
+
+	return fn(api.ChatResponse{
+		Model: req.Model,
+		Message: api.Message{
+			Role:    "assistant",
+			Content: "answer",
+		},
+		Done: true,
+	})
+}
+
+func (f *fake) Embed(ctx context.Context, req *api.EmbedRequest) (*api.EmbedResponse, error) {
+	f.embeds.Add(1)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(f.delay):
+	}
+
+	h := sha256.Sum256([]byte(fmt.Sprint(req.Input)))
+
+	v := make([]float32, 16)
+
+	for i := range v {
+		v[i] = float32(h[i])/255 + 0.01
+	}
+
+	return &api.EmbedResponse{
+		Model:      req.Model,
+		Embeddings: [][]float32{v},
+	}, nil
+}
+
+func (f *fake) Show(context.Context, *api.ShowRequest) (*api.ShowResponse, error) {
+	return &api.ShowResponse{}, nil
+}
+
+func (f *fake) Pull(context.Context, *api.PullRequest, api.PullProgressFunc) error {
+	return nil
+}
+
+func (f *fake) List(context.Context) (*api.ListResponse, error) {
+	return &api.ListResponse{
+		Models: []api.ListModelResponse{{Name: Model + ":latest"}, {Name: Embed + ":latest"}},
+	}, nil
+}
+
+func (f *fake) Heartbeat(context.Context) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+func jsonl(line string, mapping map[string]string) (map[string]string, string) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+
+	var obj map[string]any
+
+	if err := dec.Decode(&obj); err != nil || obj == nil || dec.More() {
+		return nil, "" // malformed
+	}
+
+	flat := make(map[string]string)
+
+	flatten("", obj, flat)
+
+	if len(flat) == 0 {
+		return nil, "" // empty
+	}
+
+	meta := map[string]string{
+		"format": "json",
+	}
+
+	if len(mapping) == 0 {
+		maps.Copy(meta, flat)
+	}
+
+	for key, path := range mapping {
+		if v, ok := flat[path]; ok {
+			meta[key] = v
+		}
+	}
+
+	var pairs []string
+
+	for _, k := range slices.Sorted(maps.Keys(flat)) {
+		pairs = append(pairs, k+"="+flat[k])
+	}
+
+	return meta, strings.Join(pairs, " ")
+}
+
+func flatten(prefix string, v any, flat map[string]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			flatten(join(prefix, k), e, flat)
+		}
+	case []any:
+		for i, e := range v {
+			flatten(join(prefix, fmt.Sprint(i)), e, flat)
+		}
+	case nil:
+		// skip
+	default:
+		flat[prefix] = fmt.Sprint(v)
+	}
+}
+
+func join(prefix, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+
+	return prefix + "." + key
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestJSONL(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		mapping map[string]string
+		meta    map[string]string
+		content string
+	}{
+		{
+			`{"a":{"b":1.50,"c":[true,{"d":"x"}]},"e":null}`,
+			nil,
+			map[string]string{"format": "json", "a.b": "1.50", "a.c.0": "true", "a.c.1.d": "x"},
+			"a.b=1.50 a.c.0=true a.c.1.d=x",
+		},
+		{
+			`{"@timestamp":"2024-01-02T03:04:05Z","host":{"name":"web"},"tags":["a","b"]}`,
+			map[string]string{"timestamp": "@timestamp", "host": "host.name", "user": "user.name"},
+			map[string]string{"format": "json", "timestamp": "2024-01-02T03:04:05Z", "host": "web"},
+			"@timestamp=2024-01-02T03:04:05Z host.name=web tags.0=a tags.1=b",
+		},
+		{`[1,2]`, nil, nil, ""},
+		{`{}`, nil, nil, ""},
+		{`{"a":null}`, nil, nil, ""},
+		{`{"a":1} {"b":2}`, nil, nil, ""},
+		{`{"a":`, nil, nil, ""},
+	} {
+		meta, content := jsonl(tc.line, tc.mapping)
+
+		if !maps.Equal(meta, tc.meta) || content != tc.content {
+			t.Errorf("%s:\ngot  %v %q\nwant %v %q", tc.line, meta, content, tc.meta, tc.content)
+		}
+	}
+}
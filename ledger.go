@@ -0,0 +1,70 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ledger keeps the event ids of a collection in ingest order, chromem can
+// only list them by exporting the database without holding its lock.
+type ledger struct {
+	sync.Mutex
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		order: list.New(),
+		index: make(map[string]*list.Element),
+	}
+}
+
+// push appends the ids, known ids keep their position.
+func (l *ledger) push(ids ...string) {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, id := range ids {
+		if _, ok := l.index[id]; !ok {
+			l.index[id] = l.order.PushBack(id)
+		}
+	}
+}
+
+func (l *ledger) remove(ids ...string) {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, id := range ids {
+		if e, ok := l.index[id]; ok {
+			l.order.Remove(e)
+			delete(l.index, id)
+		}
+	}
+}
+
+// oldest returns up to n ids, the first ingested first.
+func (l *ledger) oldest(n int) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	ids := make([]string, 0, min(n, l.order.Len()))
+
+	for e := l.order.Front(); e != nil && len(ids) < n; e = e.Next() {
+		ids = append(ids, e.Value.(string))
+	}
+
+	return ids
+}
+
+func (l *ledger) ids() []string {
+	return l.oldest(l.len())
+}
+
+func (l *ledger) len() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.order.Len()
+}
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/api"
+	"github.com/philippgille/chromem-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type permanent struct {
+	error
+}
+
+func (s *Server) retry(ctx context.Context, fn func() error) error {
+	var err error
+
+	delay := 500 * time.Millisecond
+
+	for i := range s.cfg.Retries {
+		err = fn()
+
+		if err == nil || errors.As(err, &permanent{}) || i == s.cfg.Retries-1 {
+			break
+		}
+
+		logs(ctx).Warn("retrying", "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+
+	return err
+}
+
+func (s *Server) acquire(ctx context.Context) (func(), error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-time.After(Wait):
+		return nil, errBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	inflight.Add(1)
+
+	return func() {
+		inflight.Add(-1)
+		<-s.slots
+	}, nil
+}
+
+func tokens(s string) int {
+	return len(s) / 4 // rough estimate
+}
+
+// truncate cuts s to at most n bytes without splitting a rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+func unavailable(fn func(string)) *Answer {
+	if fn != nil {
+		fn(Unavailable)
+	}
+
+	return &Answer{
+		Answer:  Unavailable,
+		Sources: []Source{},
+	}
+}
+
+func (s *Server) pull(name string) error {
+	_, err := s.client.Show(context.Background(), &api.ShowRequest{
+		Model: name,
+	})
+
+	if err == nil {
+		return nil // already present
+	}
+
+	slog.Info("pulling", "model", name)
+
+	var last string
+
+	return s.client.Pull(context.Background(), &api.PullRequest{
+		Model: name,
+	}, func(p api.ProgressResponse) error {
+		if p.Status != last {
+			slog.Info("pull", "model", name, "status", p.Status, "total", p.Total, "completed", p.Completed)
+			last = p.Status
+		}
+
+		return nil
+	})
+}
+
+// preload loads the model and keeps trying while ollama is down, only a
+// missing model needs an operator.
+func (s *Server) preload() {
+	for {
+		err := s.retry(context.Background(), func() error {
+			err := s.client.Chat(context.Background(), &api.ChatRequest{
+				Model:     s.cfg.Model,
+				KeepAlive: s.keepAlive,
+			}, func(_ api.ChatResponse) error {
+				return nil // preloaded model
+			})
+
+			if se := (api.StatusError{}); errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+				return permanent{err} // retrying cannot help a missing model
+			}
+
+			return err
+		})
+
+		if errors.As(err, &permanent{}) {
+			slog.Error("model not found; run `ollama pull` or enable -auto-pull", "model", s.cfg.Model)
+			return // not ready
+		}
+
+		if err == nil {
+			s.ready.Store(true)
+			return
+		}
+
+		slog.Error("preload failed", "model", s.cfg.Model, "error", err, "retry", Wait)
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(Wait):
+		}
+	}
+}
+
+// reachable probes ollama, the result is cached to spare it from probes.
+func (s *Server) reachable(ctx context.Context) error {
+	s.probe.Lock()
+	defer s.probe.Unlock()
+
+	if time.Since(s.probe.at) < Probe {
+		return s.probe.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, Probe)
+	defer cancel()
+
+	s.probe.err = s.client.Heartbeat(ctx)
+	s.probe.at = time.Now()
+
+	return s.probe.err
+}
+
+// list returns the installed models, cached briefly.
+func (s *Server) list(ctx context.Context) (*api.ListResponse, error) {
+	s.listing.Lock()
+	defer s.listing.Unlock()
+
+	if time.Since(s.listing.at) < Probe {
+		return s.listing.res, s.listing.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, Probe)
+	defer cancel()
+
+	s.listing.res, s.listing.err = s.client.List(ctx)
+	s.listing.at = time.Now()
+
+	return s.listing.res, s.listing.err
+}
+
+// installed checks that the model is pulled.
+func (s *Server) installed(ctx context.Context, model string) error {
+	res, err := s.list(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range res.Models {
+		if m.Name == model || m.Name == model+":latest" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", errModel, model)
+}
+
+func (s *Server) options() map[string]any {
+	opts := map[string]any{
+		"num_ctx":     s.cfg.NumCtx,
+		"temperature": s.cfg.Temperature,
+		"seed":        s.cfg.Seed,
+		"top_k":       s.cfg.SampleTopK,
+		"top_p":       s.cfg.SampleTopP,
+	}
+
+	if s.cfg.NumPredict > 0 {
+		opts["num_predict"] = s.cfg.NumPredict
+	}
+
+	return opts
+}
+
+func sample(docs []chromem.Document, limit int) []chromem.Document {
+	var n int
+
+	for _, doc := range docs {
+		n += tokens(doc.Content)
+	}
+
+	if n <= limit {
+		return docs
+	}
+
+	limit = max(limit, 1) // prompt alone exceeds the context
+
+	step := n/limit + 1
+
+	var res []chromem.Document
+
+	for i := 0; i < len(docs); i += step {
+		res = append(res, docs[i])
+	}
+
+	return res
+}
+
+func (s *Server) summarize(ctx context.Context, name string) (string, error) {
+	docs, err := s.documents(ctx, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(docs) == 0 {
+		return Empty, nil
+	}
+
+	slices.SortStableFunc(docs, func(a, b chromem.Document) int {
+		t1, _ := timestamp(a.Metadata)
+		t2, _ := timestamp(b.Metadata)
+
+		return t1.Compare(t2)
+	})
+
+	limit := s.cfg.Budget
+
+	if limit == 0 {
+		limit = s.cfg.NumCtx - tokens(s.system(name)+Summary)
+	}
+
+	var events string
+
+	for _, doc := range sample(docs, limit) {
+		events += render(doc.Content, doc.Metadata) + "\n"
+	}
+
+	return s.complete(ctx, name, fmt.Sprintf(Summary, events))
+}
+
+// complete asks the model outside of any conversation.
+func (s *Server) complete(ctx context.Context, name, msg string) (string, error) {
+	stream := false
+
+	req := &api.ChatRequest{
+		Model:  s.cfg.Model,
+		Stream: &stream,
+		Messages: []api.Message{{
+			Role:    "System",
+			Content: s.system(name),
+		}, {
+			Role:    "User",
+			Content: msg,
+		}},
+		KeepAlive: s.keepAlive,
+		Options:   s.options(),
+	}
+
+	release, err := s.acquire(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer release()
+
+	var content string
+
+	err = s.retry(ctx, func() error {
+		content = ""
+
+		return s.client.Chat(ctx, req, func(res api.ChatResponse) error {
+			content += res.Message.Content
+			return nil
+		})
+	})
+
+	return content, err
+}
+
+func chunks(res []chromem.Result, limit int) [][]chromem.Result {
+	var all [][]chromem.Result
+	var chunk []chromem.Result
+	var n int
+
+	for _, r := range res {
+		t := tokens(r.Content + "\n")
+
+		if t > limit {
+			if limit <= 0 {
+				continue // nothing fits
+			}
+
+			r.Content = truncate(r.Content, 4*limit) // fills a chunk alone
+			t = tokens(r.Content + "\n")
+		}
+
+		if n+t > limit {
+			all = append(all, chunk)
+			chunk, n = nil, 0
+		}
+
+		chunk = append(chunk, r)
+		n += t
+	}
+
+	if len(chunk) > 0 {
+		all = append(all, chunk)
+	}
+
+	return all
+}
+
+func lines(res []chromem.Result) string {
+	var events string
+
+	for _, r := range res {
+		events += render(r.Content, r.Metadata) + "\n"
+	}
+
+	return events
+}
+
+// render restores the header of events stored without it.
+func render(content string, meta map[string]string) string {
+	if meta["format"] != "syslog" {
+		return content
+	}
+
+	var parts []string
+
+	for _, k := range []string{"timestamp", "host", "app"} {
+		if v, ok := meta[k]; ok {
+			parts = append(parts, v)
+		}
+	}
+
+	return strings.Join(append(parts, content), " ")
+}
+
+// system returns the configured prompt or the default one describing the
+// formats ingested into the collection.
+func (s *Server) system(name string) string {
+	if len(s.cfg.Prompt) > 0 {
+		return s.cfg.Prompt
+	}
+
+	var names []string
+
+	for _, f := range slices.Sorted(maps.Keys(descriptions)) {
+		if _, ok := s.formats.Load(name + "/" + f); ok {
+			names = append(names, descriptions[f])
+		}
+	}
+
+	if len(names) == 0 {
+		names = append(names, descriptions["cef"])
+	}
+
+	return fmt.Sprintf(Prompt, strings.Join(names, " or "))
+}
+
+func (s *Server) extract(ctx context.Context, name, query string, all [][]chromem.Result) (string, error) {
+	var facts string
+
+	for i, chunk := range all {
+		content, err := s.complete(ctx, name, fmt.Sprintf(Extract, query, lines(chunk)))
+
+		if err != nil {
+			return "", err
+		}
+
+		logs(ctx).Debug("extract", "chunk", i+1, "chunks", len(all), "events", len(chunk))
+
+		facts += strings.TrimSpace(content) + "\n"
+	}
+
+	return facts, nil
+}
+
+// input frames the question and the context for the model.
+func (s *Server) input(query, events string) (string, error) {
+	if s.cfg.Template == nil {
+		return fmt.Sprintf(Query, query, events), nil
+	}
+
+	var b strings.Builder
+
+	err := s.cfg.Template.Execute(&b, Frame{
+		Question: query,
+		Context:  events,
+	})
+
+	return b.String(), err
+}
+
+// rerank orders the results by the relevance rated by the model and keeps
+// the best n, unrated results keep their order behind the rated ones.
+func (s *Server) rerank(ctx context.Context, name, query string, res []chromem.Result, n, limit int) ([]chromem.Result, error) {
+	all := chunks(res, limit)
+
+	if len(all) == 0 {
+		return res[:0], nil
+	}
+
+	res = all[0] // fits
+
+	var events string
+
+	for i, r := range res {
+		events += fmt.Sprintf("%d: %s\n", i+1, render(r.Content, r.Metadata))
+	}
+
+	content, err := s.complete(ctx, name, fmt.Sprintf(Rerank, query, events))
+
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(res))
+
+	for _, m := range rating.FindAllStringSubmatch(content, -1) {
+		i, _ := strconv.Atoi(m[1])
+		v, _ := strconv.ParseFloat(m[2], 64)
+
+		if i > 0 && i <= len(res) {
+			scores[i-1] = v + 1 // rated
+		}
+	}
+
+	idx := make([]int, len(res))
+
+	for i := range idx {
+		idx[i] = i
+	}
+
+	slices.SortStableFunc(idx, func(a, b int) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+
+	ranked := make([]chromem.Result, 0, min(n, len(res)))
+
+	for _, i := range idx[:min(n, len(res))] {
+		ranked = append(ranked, res[i])
+	}
+
+	return ranked, nil
+}
+
+func (s *Server) retrieve(ctx context.Context, q Question) ([]chromem.Result, error) {
+	var res []chromem.Result
+
+	s.lock.RLock()
+	col := s.get(q.Case)
+	s.lock.RUnlock()
+
+	if col == nil || col.Count() == 0 {
+		return nil, errEmpty
+	}
+
+	var doc map[string]string
+	var words []string
+
+	if q.Mode == "hybrid" {
+		words = terms(q.Query)
+	}
+
+	if len(words) > 0 {
+		doc = map[string]string{"$contains": words[0]}
+	}
+
+	err := s.retry(ctx, func() (err error) {
+		n := min(q.TopK, col.Count()) // events are deleted concurrently
+
+		if q.From != nil || q.To != nil || len(words) > 1 {
+			n = col.Count() // post-filtered
+		}
+
+		if n == 0 {
+			res = nil
+			return nil
+		}
+
+		res, err = col.Query(ctx, q.Query, n, q.Where, doc)
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	res = between(res, q.From, q.To)
+
+	if len(words) > 1 {
+		res = containing(res, words[1:])
+	}
+
+	return res[:min(len(res), q.TopK)], nil
+}
+
+func (s *Server) query(ctx context.Context, session string, q Question, fn func(string)) (*Answer, error) {
+	start := time.Now()
+
+	model := s.cfg.Model
+
+	if len(q.Model) > 0 && q.Model != model {
+		if err := s.installed(ctx, q.Model); err != nil {
+			return nil, err
+		}
+
+		model = q.Model
+	}
+
+	d := s.cfg.Timeout
+
+	if q.Timeout != nil {
+		d = q.Timeout.Duration
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	attrs := []attribute.KeyValue{
+		attribute.String("case", q.Case),
+		attribute.Int("topk", q.TopK),
+	}
+
+	ctx, sp := span(ctx, "query", attrs...)
+	defer sp.End()
+
+	k := q.TopK
+
+	if s.cfg.Lambda < 1 || s.cfg.Rerank {
+		q.TopK = max(k, k*Candidates) // rerank, overflow
+	}
+
+	rctx, rs := span(ctx, "retrieve", attrs...)
+
+	res, err := s.retrieve(rctx, q)
+
+	end(rs, err)
+
+	if errors.Is(err, errEmpty) {
+		if fn != nil {
+			fn(Empty)
+		}
+
+		return &Answer{
+			Answer:  Empty,
+			Sources: []Source{},
+		}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res = slices.DeleteFunc(res, func(r chromem.Result) bool {
+		return r.Similarity < float32(s.cfg.Similarity)
+	})
+
+	res, collapsed := unique(res)
+
+	if s.cfg.Lambda < 1 {
+		m := k
+
+		if s.cfg.Rerank {
+			m = len(res) // order only
+		}
+
+		res = mmr(res, m, s.cfg.Lambda)
+	}
+
+	if s.cfg.Rerank && len(res) > 0 {
+		rctx, rs := span(ctx, "rerank", append(attrs, attribute.Int("candidates", len(res)))...)
+
+		res, err = s.rerank(rctx, q.Case, q.Query, res, k, q.NumCtx-tokens(s.system(q.Case)+q.Query+Rerank))
+
+		end(rs, err)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(res) == 0 { // nothing matched, the model would guess
+		return unavailable(fn), nil
+	}
+
+	var events string
+
+	actx, as := span(ctx, "assemble", attrs...)
+
+	system := s.system(q.Case)
+
+	if len(q.System) > 0 {
+		system = q.System
+	}
+
+	var past []api.Message
+
+	if !q.Stateless {
+		past = s.history(session, q.Case)[1:] // without prompt
+	}
+
+	limit := s.cfg.Budget
+
+	if limit == 0 {
+		frame, _ := s.input("", "")
+
+		limit = q.NumCtx - tokens(system+q.Query) - max(tokens(frame), tokens(Extract))
+
+		for _, m := range past {
+			limit -= tokens(m.Content) // earlier turns
+		}
+	}
+
+	all := chunks(res, limit)
+
+	if len(all) == 0 { // nothing fits the context
+		end(as, nil)
+
+		return unavailable(fn), nil
+	}
+
+	if !s.cfg.MapReduce {
+		all = all[:min(len(all), 1)] // truncate
+	}
+
+	sources := make([]Source, 0, len(res))
+
+	for _, chunk := range all {
+		for _, r := range chunk {
+			sources = append(sources, Source{
+				ID:         r.ID,
+				Content:    r.Content,
+				Similarity: r.Similarity,
+			})
+		}
+	}
+
+	if len(all) > 1 {
+		events, err = s.extract(actx, q.Case, q.Query, all)
+	} else if len(all) == 1 {
+		events = lines(all[0])
+	}
+
+	as.SetAttributes(attribute.Int("sources", len(sources)), attribute.Int("chunks", len(all)))
+
+	end(as, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := s.input(q.Query, events)
+
+	if err != nil {
+		return nil, err
+	}
+
+	turn := api.Message{
+		Role:    "User",
+		Content: input,
+	}
+
+	msgs := []api.Message{{
+		Role:    "System",
+		Content: system, // this request only
+	}}
+
+	msgs = append(append(msgs, past...), turn)
+
+	stream := fn != nil
+
+	req := &api.ChatRequest{
+		Model:     model,
+		Stream:    &stream,
+		Messages:  msgs,
+		KeepAlive: s.keepAlive,
+		Options:   s.options(),
+	}
+
+	req.Options["num_ctx"] = q.NumCtx
+
+	if q.NumPredict > 0 {
+		req.Options["num_predict"] = q.NumPredict
+	}
+
+	if q.Temperature != nil {
+		req.Options["temperature"] = *q.Temperature
+	}
+
+	if q.Seed != nil {
+		req.Options["seed"] = *q.Seed
+	}
+
+	if q.SampleTopK != nil {
+		req.Options["top_k"] = *q.SampleTopK
+	}
+
+	if q.SampleTopP != nil {
+		req.Options["top_p"] = *q.SampleTopP
+	}
+
+	release, err := s.acquire(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	var answers []string
+	var usage Usage
+
+	seed := req.Options["seed"].(int)
+
+	for i := range max(q.N, 1) {
+		var content string
+
+		req.Options["seed"] = seed + i // vary
+
+		cctx, cs := span(ctx, "chat", append(attrs, attribute.String("model", model))...)
+
+		err = s.retry(cctx, func() error {
+			err := s.client.Chat(cctx, req, func(res api.ChatResponse) error {
+				content += res.Message.Content
+
+				if fn != nil {
+					fn(res.Message.Content)
+				}
+
+				if res.Done {
+					usage.Prompt += res.PromptEvalCount
+					usage.Completion += res.EvalCount
+				}
+
+				return nil
+			})
+
+			if err != nil && len(content) > 0 {
+				return permanent{err} // already answered partially
+			}
+
+			return err
+		})
+
+		end(cs, err)
+
+		if err != nil {
+			return nil, err
+		}
+
+		answers = append(answers, content)
+	}
+
+	content := answers[0]
+
+	if !q.Stateless {
+		s.remember(session, q.Case, api.Message{
+			Role:    "User",
+			Content: q.Query, // the events of this turn would crowd out the next
+		}, api.Message{
+			Role:    "Assistant",
+			Content: content,
+		})
+	}
+
+	logs(ctx).Info("query",
+		"case", q.Case,
+		"session", session,
+		"sources", len(sources),
+		"latency", time.Since(start),
+	)
+
+	answer := &Answer{
+		Answer:  content,
+		Sources: sources,
+		Usage:   &usage,
+	}
+
+	if len(answers) > 1 {
+		answer.Answers = answers
+	}
+
+	if q.Debug {
+		answer.Debug = &Debug{
+			Context:   events,
+			Prompt:    input,
+			Collapsed: collapsed,
+		}
+	}
+
+	return answer, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/philippgille/chromem-go"
+)
+
+// run with -race, queries share the sessions, slots and collections.
+func TestQueryConcurrent(t *testing.T) {
+	f := &fake{}
+	s := server(t, config(), f)
+
+	for _, line := range []string{"login failed for root", "login ok for alice"} {
+		_, err := s.add(context.Background(), Event{Case: Collection, Content: line})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for range 2 {
+		wg.Go(func() {
+			q := Question{
+				Query:  "who failed to login?",
+				Case:   Collection,
+				TopK:   s.cfg.TopK,
+				NumCtx: s.cfg.NumCtx,
+			}
+
+			answer, err := s.query(context.Background(), Session, q, nil)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if answer.Answer != "answer" || len(answer.Sources) == 0 {
+				t.Errorf("unexpected answer %+v", answer)
+			}
+		})
+	}
+
+	wg.Wait()
+
+	msgs := s.messages(Session)
+
+	if len(msgs) != 5 {
+		t.Fatalf("expected 5 messages, got %d", len(msgs))
+	}
+
+	if msgs[1].Content != "who failed to login?" {
+		t.Errorf("expected the bare question in the history, got %q", msgs[1].Content)
+	}
+}
+
+func TestQueryNothingRetrieved(t *testing.T) {
+	f := &fake{}
+	s := server(t, config(), f)
+
+	_, err := s.add(context.Background(), Event{Case: Collection, Content: "CEF:0|Fox|Test|1.0|100|login failed|5|src=10.0.0.1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := Question{
+		Query:  "who failed to login?",
+		Case:   Collection,
+		Where:  map[string]string{"src": "10.0.0.2"},
+		TopK:   s.cfg.TopK,
+		NumCtx: s.cfg.NumCtx,
+	}
+
+	answer, err := s.query(context.Background(), Session, q, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if answer.Answer != Unavailable || f.chats.Load() != 0 || len(s.messages(Session)) != 0 {
+		t.Errorf("expected %q without a chat, got %+v", Unavailable, answer)
+	}
+}
+
+func TestSample(t *testing.T) {
+	docs := make([]chromem.Document, 10)
+
+	for i := range docs {
+		docs[i].Content = strings.Repeat("word ", 20)
+	}
+
+	for _, limit := range []int{-60, -1, 0, 1, 50, 10000} {
+		res := sample(docs, limit)
+
+		if len(res) == 0 || len(res) > len(docs) {
+			t.Errorf("limit %d: sampled %d of %d", limit, len(res), len(docs))
+		}
+	}
+}
+
+func TestSummarizeEmpty(t *testing.T) {
+	f := &fake{}
+	s := server(t, config(), f)
+
+	summary, err := s.summarize(context.Background(), Collection)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary != Empty || f.chats.Load() != 0 {
+		t.Errorf("expected %q without a chat, got %q", Empty, summary)
+	}
+}
+
+func TestQueryOversized(t *testing.T) {
+	f := &fake{}
+	s := server(t, config(), f)
+
+	_, err := s.add(context.Background(), Event{Case: Collection, Content: strings.Repeat("ä", 13000)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := Question{
+		Query:     "what happened?",
+		Case:      Collection,
+		TopK:      s.cfg.TopK,
+		NumCtx:    s.cfg.NumCtx,
+		Stateless: true,
+	}
+
+	answer, err := s.query(context.Background(), Session, q, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(answer.Sources) != 1 || !utf8.ValidString(answer.Sources[0].Content) || tokens(answer.Sources[0].Content) > q.NumCtx {
+		t.Errorf("expected a truncated source, got %d sources", len(answer.Sources))
+	}
+
+	q.NumCtx = 10 // smaller than the prompt
+
+	answer, err = s.query(context.Background(), Session, q, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if answer.Answer != Unavailable || f.chats.Load() != 1 {
+		t.Errorf("expected %q without a chat, got %q", Unavailable, answer.Answer)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"aäb", 2, "a"}, // ä is two bytes
+		{"aäb", 3, "aä"},
+		{"äöü", 0, ""},
+	} {
+		if got := truncate(tc.s, tc.n); got != tc.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.want)
+		}
+	}
+}
@@ -5,29 +5,94 @@ Use with fox:
 
 	fox hunt -uhttp://0.0.0.0:8211/event *.evtx
 
+Ingest RFC 5424 syslog lines:
+
+	curl -X POST "0.0.0.0:8211/event?format=syslog" --data-binary @messages.log
+
+Ingest JSON lines, keeping only some fields as metadata (-json-fields timestamp=@timestamp,host=host.name):
+
+	curl -X POST "0.0.0.0:8211/event?format=json" --data-binary @events.jsonl
+
+Wait until ingested events are searchable (queued is 0 and inflight is false):
+
+	curl 0.0.0.0:8211/ingest/status
+
+Upload whole log files:
+
+	curl -X POST "0.0.0.0:8211/upload?format=syslog" -F file=@messages.log -F file=@secure.log
+
 Query server:
 
 	curl -X POST 0.0.0.0:8211/query -d "are there critical events?"
+
+Or ad-hoc from a browser:
+
+	curl "0.0.0.0:8211/query?q=are+there+critical+events"
+
+Restrict to a time range (events without a parseable timestamp are skipped):
+
+	curl -X POST "0.0.0.0:8211/query?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z" -d "any failed logons?"
+
+Match quoted tokens or identifiers literally:
+
+	curl -X POST "0.0.0.0:8211/query?mode=hybrid" -d 'any logons from "4.3.2.1"?'
+
+Correct an event, its id stays the same although it was derived from the original content:
+
+	curl -X PUT 0.0.0.0:8211/event/16dced4ac3af5eb2 -d "corrected line"
+
+Ask without the conversation history:
+
+	curl -X POST "0.0.0.0:8211/query?stateless=true" -d "are there critical events?"
+
+Checkpoint a case including its embeddings and load it back later (-snapshot-dir):
+
+	curl -X POST "0.0.0.0:8211/snapshot?file=case.snapshot"
+	curl -X POST "0.0.0.0:8211/restore?file=case.snapshot"
+
+Check the embedding quality with the nearest neighbors of a probe:
+
+	curl "0.0.0.0:8211/event?probe=failed+logon&n=5"
+
+Search events without the LLM:
+
+	curl "0.0.0.0:8211/search?q=failed+logon&limit=5&offset=10"
+
+Stream answer:
+
+	curl -X POST 0.0.0.0:8211/query -H "Accept: text/event-stream" -d "are there critical events?"
+
+Chat over a WebSocket with its own history, each question is answered by
+"token" frames followed by a "done" frame with the sources:
+
+	websocat ws://0.0.0.0:8211/ws
 */
 package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/ollama/ollama/api"
-	"github.com/philippgille/chromem-go"
-	"github.com/zeebo/xxh3"
 )
 
 const Prompt = `
 You are a helpful digital forensic analyst and expert witness, tasked with answering questions about text based log lines. Answer the given question solely based on the provided context. Answer the question in a very concise manner. Use an unbiased and professional tone. Cite relevant lines starting with their timestamp.
 
-The lines are in Common Event Format (CEF) and not part of the conversation with the user. The lines are not in chronological order and start with a timestamp followed by the hostname and the message.
+The lines are in %s and not part of the conversation with the user. The lines are not in chronological order and start with a timestamp followed by the hostname and the message.
 
 If you can't the answer the question based on the provided context, answer with: "This information is not available". Do not repeat text. Don't make anything up.
 
@@ -42,162 +107,489 @@ This is the question:
 This is the context:
 %s
 `
+const Summary = `
+Summarize what happened based solely on the following lines. Give a high-level incident overview in a few sentences and highlight critical events.
+
+These are the lines:
+%s
+`
+const Extract = `
+Extract the facts relevant to the question from the following lines. Keep the timestamps and hostnames. Answer with "None" if no line is relevant.
+
+This is the question:
+%s
+
+These are the lines:
+%s
+`
+const Rerank = `
+Rate how relevant each of the following numbered lines is to the question on a scale from 0 to 10. Answer with one "number: rating" pair per line and nothing else.
+
+This is the question:
+%s
+
+These are the lines:
+%s
+`
+const Unavailable = "This information is not available"
+const Empty = "No events have been ingested yet."
 const Model = "mistral"
 const Embed = "nomic-embed-text"
+const Addr = "0.0.0.0:8211"
+const Session = "default"
+const Sessions = 1000
+const Idle = 24 * time.Hour
+const Collection = "fox"
+const Ctx = 4096
+const Limit = 1000
+const Candidates = 4
+const Choices = 5
+const Window = 1000
+const Wait = 10 * time.Second
+const Probe = 5 * time.Second
+
+// set at build time:
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.commit=$(git rev-parse --short HEAD)"
+var version = "dev"
+var commit = "none"
+
+var descriptions = map[string]string{
+	"cef":    "Common Event Format (CEF)",
+	"syslog": "RFC 5424 syslog format",
+	"json":   "JSON objects flattened into key=value pairs",
+}
+
+var host = flag.String("ollama-host", "", "ollama url (overrides OLLAMA_HOST)")
+var coll = flag.String("collection", Collection, "default collection")
+var model = flag.String("model", env("FOX_MODEL", Model), "chat model")
+var embed = flag.String("embed", env("FOX_EMBED", Embed), "embedding model")
+var addr = flag.String("addr", env("FOX_ADDR", Addr), "listen address")
+var path = flag.String("db", "", "database directory")
+var cert = flag.String("tls-cert", "", "tls certificate file")
+var certKey = flag.String("tls-key", "", "tls key file")
+var maxBody = flag.Int64("max-body", 32<<20, "max request body size in bytes")
+var similarity = flag.Float64("min-similarity", 0, "min similarity of retrieved events")
+var mapReduce = flag.Bool("map-reduce", false, "extract facts from all retrieved events in chunks (multiplies llm calls)")
+var lambda = flag.Float64("mmr-lambda", 1, "relevance vs diversity of retrieved events (1 disables mmr)")
+var rerank = flag.Bool("rerank", false, "rerank retrieved events with the llm (adds a llm call per query)")
+var numCtx = flag.Int("num-ctx", Ctx, "llm context window in tokens")
+var numPredict = flag.Int("num-predict", 0, "max tokens per answer (0 is unlimited)")
+var debug = flag.Bool("debug", false, "include the llm context in json answers")
+var rps = flag.Float64("rate", 0, "requests per second per client (0 disables)")
+var burst = flag.Int("burst", 10, "request burst per client")
+var origins = flag.String("cors-origins", "", "allowed cors origins (comma separated)")
+var proxies = flag.String("trusted-proxies", "", "proxies trusted to set the client ip (comma separated cidrs, default none)")
+var mapping = flag.String("json-fields", "", "json metadata fields as key=path, e.g. timestamp=@timestamp,host=host.name (comma separated, default all)")
+var key = flag.String("api-key", env("FOX_API_KEY", ""), "api key")
+var topk = flag.Int("topk", 20, "number of retrieved events")
+var temperature = flag.Float64("temperature", 0.2, "llm sampling temperature")
+var seed = flag.Int("seed", 8211, "llm sampling seed")
+var sampleTopK = flag.Int("top-k", 10, "llm sampling top_k (not the number of retrieved events)")
+var sampleTopP = flag.Float64("top-p", 0.5, "llm sampling top_p")
+var file = flag.String("prompt", "", "system prompt file")
+var tmpl = flag.String("query-template", "", "query template file with {{.Question}} and {{.Context}}")
+var budget = flag.Int("budget", 0, "context token budget (0 derives from num_ctx)")
+var retries = flag.Int("retries", 5, "max attempts for ollama calls")
+var level = flag.String("log-level", "info", "log level")
+var format = flag.String("log-format", "text", "log format (text or json)")
+var timeout = flag.Duration("query-timeout", 2*time.Minute, "query timeout")
+var parallel = flag.Int("max-concurrent-queries", 4, "max concurrent llm queries")
+var turns = flag.Int("max-history", 10, "max conversation turns")
+var autoPull = flag.Bool("auto-pull", false, "pull missing models on startup")
+var buffer = flag.Int("buffer", 4096, "ingest queue size")
+var workers = flag.Int("workers", 1, "number of ingest workers")
+var ttl = flag.Duration("ttl", 0, "expire events with a timestamp older than this (0 disables)")
+var snapshots = flag.String("snapshot-dir", "", "directory for snapshots (empty disables them)")
+var hash = flag.String("id-hash", "xxh3", "event id hash (xxh3 or sha256), changing it breaks deduplication of a persistent db")
+var maxEvents = flag.Int("max-events", 0, "evict the oldest events above this many per collection (0 disables)")
+var batch = flag.Int("batch-size", 64, "ingest batch size")
+var flush = flag.Duration("flush-interval", time.Second, "ingest batch flush interval")
+var every = flag.Int("progress-every", 10000, "log ingest progress every n events (0 disables)")
+var alive = flag.String("keepalive", "1h", "model keep alive (-1 keeps loaded, 0 unloads)")
+
+func env(key, value string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return value
+}
+
+func duration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil // ollama semantics
+	}
 
-var db = chromem.NewDB()
-var stream = false
-var messages []api.Message
-var keepAlive = &api.Duration{Duration: time.Hour}
+	return time.ParseDuration(s)
+}
 
-func history(role, msg string) {
-	messages = append(messages, api.Message{
-		Role:    role,
-		Content: msg,
-	})
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-func consume(events chan string) {
-	fn := chromem.NewEmbeddingFuncOllama(Embed, "")
+func main() {
+	var err error
+
+	flag.Parse()
 
-	col, err := db.GetOrCreateCollection("fox", nil, fn)
+	var lvl slog.Level
+
+	err = lvl.UnmarshalText([]byte(*level))
 
 	if err != nil {
-		panic(err)
+		fatal("invalid log level", "level", *level)
 	}
 
-	for event := range events {
-		err = col.AddDocument(context.Background(), chromem.Document{
-			ID:      fmt.Sprintf("%x", xxh3.HashString(event)),
-			Content: event,
-		})
+	opts := &slog.HandlerOptions{Level: lvl}
 
-		if err != nil {
-			panic(err)
-		}
+	switch *format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		fatal("invalid log format", "format", *format)
 	}
-}
 
-func preload(client *api.Client) {
-	err := client.Chat(context.Background(), &api.ChatRequest{
-		Model:     Model,
-		KeepAlive: keepAlive,
-	}, func(_ api.ChatResponse) error {
-		return nil // preloaded model
-	})
+	if len(*coll) == 0 {
+		fatal("collection is required")
+	}
 
-	if err != nil {
-		panic(err)
+	if len(*model) == 0 {
+		fatal("model is required")
 	}
-}
 
-func query(client *api.Client, input string) chan string {
-	col := db.GetCollection("fox", nil)
+	if len(*embed) == 0 {
+		fatal("embedding model is required")
+	}
+
+	if *temperature < 0 {
+		fatal("temperature must not be negative")
+	}
+
+	if *sampleTopK < 1 {
+		fatal("top-k must be positive")
+	}
+
+	if *sampleTopP <= 0 || *sampleTopP > 1 {
+		fatal("top-p must be greater than 0 and at most 1")
+	}
+
+	if *topk < 1 {
+		fatal("topk must be positive")
+	}
+
+	if *numCtx < 1 {
+		fatal("num-ctx must be positive")
+	}
+
+	if *numPredict < 0 {
+		fatal("num-predict must not be negative")
+	}
+
+	if *budget < 0 {
+		fatal("budget must not be negative")
+	}
 
-	res, err := col.Query(context.Background(), input, col.Count(), nil, nil)
+	if *retries < 1 {
+		fatal("retries must be positive")
+	}
+
+	if *workers < 1 {
+		fatal("workers must be positive")
+	}
+
+	if *timeout <= 0 {
+		fatal("query-timeout must be positive")
+	}
+
+	if *similarity < -1 || *similarity > 1 {
+		fatal("min-similarity must be between -1 and 1")
+	}
+
+	if *lambda < 0 || *lambda > 1 {
+		fatal("mmr-lambda must be between 0 and 1")
+	}
+
+	if *rps < 0 || *burst < 1 {
+		fatal("invalid rate limit")
+	}
+
+	if *maxBody < 1 {
+		fatal("max-body must be positive")
+	}
+
+	if *parallel < 1 {
+		fatal("max-concurrent-queries must be positive")
+	}
+
+	if *turns < 0 {
+		fatal("max-history must not be negative")
+	}
+
+	if *buffer < 1 {
+		fatal("buffer must be positive")
+	}
+
+	if *hash != "xxh3" && *hash != "sha256" {
+		fatal("id-hash must be xxh3 or sha256")
+	}
+
+	if *ttl < 0 {
+		fatal("ttl must not be negative")
+	}
+
+	if *maxEvents < 0 {
+		fatal("max-events must not be negative")
+	}
+
+	if *batch < 1 {
+		fatal("batch-size must be positive")
+	}
+
+	if *flush <= 0 {
+		fatal("flush-interval must be positive")
+	}
+
+	if *every < 0 {
+		fatal("progress-every must not be negative")
+	}
+
+	keepAlive, err := duration(*alive)
 
 	if err != nil {
-		panic(err)
+		fatal("invalid keepalive", "error", err)
 	}
 
-	var events string
+	cfg := Config{
+		Collection:  *coll,
+		Model:       *model,
+		Embed:       *embed,
+		DB:          *path,
+		Key:         *key,
+		MaxBody:     *maxBody,
+		Similarity:  *similarity,
+		Debug:       *debug,
+		MapReduce:   *mapReduce,
+		Rerank:      *rerank,
+		Lambda:      *lambda,
+		Rate:        *rps,
+		Burst:       *burst,
+		TopK:        *topk,
+		NumCtx:      *numCtx,
+		NumPredict:  *numPredict,
+		Temperature: *temperature,
+		Seed:        *seed,
+		SampleTopK:  *sampleTopK,
+		SampleTopP:  *sampleTopP,
+		Budget:      *budget,
+		Retries:     *retries,
+		Timeout:     *timeout,
+		Parallel:    *parallel,
+		Turns:       *turns,
+		Buffer:      *buffer,
+		Batch:       *batch,
+		Flush:       *flush,
+		Progress:    *every,
+		Workers:     *workers,
+		Hash:        *hash,
+		Snapshots:   *snapshots,
+		MaxEvents:   *maxEvents,
+		TTL:         *ttl,
+		KeepAlive:   keepAlive,
+	}
 
-	for _, r := range res {
-		events += r.Content + "\n"
+	if len(*snapshots) > 0 {
+		if err := os.MkdirAll(*snapshots, 0o750); err != nil {
+			fatal("invalid snapshot-dir", "error", err)
+		}
 	}
 
-	history("User", fmt.Sprintf(Query, input, events))
+	if len(*origins) > 0 {
+		cfg.Origins = strings.Split(*origins, ",")
+	}
 
-	req := &api.ChatRequest{
-		Model:     Model,
-		Stream:    &stream,
-		Messages:  messages,
-		KeepAlive: keepAlive,
-		Options: map[string]any{
-			"num_ctx":     4096,
-			"temperature": 0.2,
-			"seed":        8211,
-			"top_k":       10,
-			"top_p":       0.5,
-		},
+	if len(*proxies) > 0 {
+		cfg.Proxies = strings.Split(*proxies, ",")
 	}
 
-	answer := make(chan string, 1)
+	if len(*mapping) > 0 {
+		cfg.Fields = make(map[string]string)
 
-	go func() {
-		err = client.Chat(context.Background(), req, func(res api.ChatResponse) error {
-			history("Assistant", res.Message.Content)
+		for _, f := range strings.Split(*mapping, ",") {
+			k, v, ok := strings.Cut(f, "=")
+
+			if !ok {
+				v = k
+			}
+
+			if len(k) == 0 || len(v) == 0 {
+				fatal("invalid json-fields", "field", f)
+			}
 
-			answer <- res.Message.Content
+			cfg.Fields[k] = v
+		}
+	}
 
-			close(answer)
-			return nil
-		})
+	if len(*file) > 0 {
+		b, err := os.ReadFile(*file)
 
 		if err != nil {
-			panic(err)
+			fatal("invalid prompt", "error", err)
 		}
-	}()
 
-	return answer
-}
+		cfg.Prompt = string(b)
+	}
 
-func main() {
-	var events = make(chan string, 4096)
+	if len(*tmpl) > 0 {
+		b, err := os.ReadFile(*tmpl)
 
-	client, err := api.ClientFromEnvironment()
+		if err != nil {
+			fatal("invalid query-template", "error", err)
+		}
+
+		cfg.Template, err = template.New("query").Parse(string(b))
+
+		if err == nil {
+			err = cfg.Template.Execute(io.Discard, Frame{}) // unknown fields
+		}
+
+		if err != nil {
+			fatal("invalid query-template", "error", err)
+		}
+	}
+
+	shutdown, err := tracing(context.Background())
 
 	if err != nil {
-		panic(err)
+		fatal("invalid tracing", "error", err)
 	}
 
-	go preload(client)
+	client, err := api.ClientFromEnvironment()
+
+	if len(*host) > 0 {
+		var u *url.URL
 
-	go consume(events)
+		if !strings.Contains(*host, "://") {
+			*host = "http://" + *host
+		}
 
-	history("System", Prompt)
+		u, err = url.Parse(*host)
 
-	server := gin.Default()
+		if err == nil {
+			client = api.NewClient(u, http.DefaultClient) // overrides OLLAMA_HOST
+		}
+	}
 
-	server.GET("/event", func(c *gin.Context) {
-		col := db.GetCollection("fox", nil)
+	if err != nil {
+		fatal("invalid ollama client", "error", err)
+	}
 
-		count := fmt.Sprintf("%d events", col.Count())
+	server, err := NewServer(cfg, client)
 
-		c.String(http.StatusOK, count)
-	})
+	if err != nil {
+		fatal("invalid database", "error", err)
+	}
 
-	server.POST("/event", func(c *gin.Context) {
-		body, err := io.ReadAll(c.Request.Body)
+	slog.Info("starting",
+		"version", version,
+		"addr", *addr,
+		"collection", *coll,
+		"model", *model,
+		"embed", *embed,
+		"ollama-host", *host,
+		"db", *path,
+		"prompt", *file,
+		"query-template", *tmpl,
+		"topk", *topk,
+		"temperature", *temperature,
+		"seed", *seed,
+		"top-k", *sampleTopK,
+		"top-p", *sampleTopP,
+		"budget", *budget,
+		"num-ctx", *numCtx,
+		"num-predict", *numPredict,
+		"retries", *retries,
+		"workers", *workers,
+		"id-hash", *hash,
+		"max-events", *maxEvents,
+		"ttl", *ttl,
+		"buffer", *buffer,
+		"batch-size", *batch,
+		"auto-pull", *autoPull,
+		"auth", len(*key) > 0,
+		"tls", len(*cert) > 0,
+		"keepalive", keepAlive,
+	)
 
-		if err != nil {
-			_ = c.Error(err)
-			return
+	go func() {
+		if *autoPull {
+			for _, name := range []string{*model, *embed} {
+				err := server.pull(name)
+
+				if err != nil {
+					slog.Error("pull failed", "model", name, "error", err)
+				}
+			}
 		}
 
-		events <- string(body)
+		server.preload()
+	}()
 
-		c.Status(http.StatusOK)
-	})
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: server,
+	}
 
-	server.POST("/query", func(c *gin.Context) {
-		body, err := io.ReadAll(c.Request.Body)
+	if len(*cert) > 0 || len(*certKey) > 0 {
+		pair, err := tls.LoadX509KeyPair(*cert, *certKey)
 
 		if err != nil {
-			_ = c.Error(err)
-			return
+			fatal("invalid tls certificate", "error", err)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{pair},
 		}
+	}
 
-		answer := <-query(client, string(body))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		c.String(http.StatusOK, answer)
-	})
+	go func() {
+		var err error
 
-	err = server.Run("0.0.0.0:8211")
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("server failed", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	slog.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = srv.Shutdown(ctx)
 
 	if err != nil {
-		panic(err)
+		slog.Error("shutdown failed", "error", err)
 	}
 
-	close(events)
+	server.Close() // drain events
+
+	err = shutdown(ctx)
+
+	if err != nil {
+		slog.Error("tracing shutdown failed", "error", err)
+	}
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+type scope struct{}
+
+var requestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// logs returns the request scoped logger.
+func logs(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(scope{}).(*slog.Logger); ok {
+		return l
+	}
+
+	return slog.Default()
+}
+
+func identify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+
+		if !requestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+
+		ctx := context.WithValue(c.Request.Context(), scope{}, slog.Default().With("request_id", id))
+
+		c.Request = c.Request.WithContext(ctx)
+	}
+}
+
+func logger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		logs(c.Request.Context()).Info("request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"client", c.ClientIP(),
+		)
+	}
+}
+
+func (s *Server) throttle(r rate.Limit, b int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r == 0 {
+			return
+		}
+
+		v, _ := s.limiters.LoadOrStore(c.ClientIP(), rate.NewLimiter(r, b))
+
+		res := v.(*rate.Limiter).Reserve()
+
+		if d := res.Delay(); d > 0 {
+			res.Cancel()
+
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			fail(c, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+		}
+	}
+}
+
+// sweep periodically removes the limiters of idle clients, a full bucket
+// behaves like a new limiter.
+func (s *Server) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.limiters.Range(func(k, v any) bool {
+				if l := v.(*rate.Limiter); l.Tokens() >= float64(l.Burst()) {
+					s.limiters.Delete(k)
+				}
+
+				return true
+			})
+		}
+	}
+}
+
+func limit(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+	}
+}
+
+func cors(origins []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+
+		if len(origin) == 0 || !(slices.Contains(origins, origin) || slices.Contains(origins, "*")) {
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Content-Encoding, Accept, X-Session-ID, X-Request-ID")
+		c.Header("Access-Control-Expose-Headers", "X-Request-ID")
+		c.Header("Vary", "Origin")
+
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+		}
+	}
+}
+
+func auth(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path == "/healthz" || c.Request.URL.Path == "/version" {
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			fail(c, http.StatusUnauthorized, errors.New("unauthorized"))
+		}
+	}
+}
+
+func recovery(c *gin.Context, err any) {
+	logs(c.Request.Context()).Error("panic", "path", c.Request.URL.Path, "error", err)
+
+	fail(c, http.StatusInternalServerError, errors.New("internal server error"))
+}
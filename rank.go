@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/philippgille/chromem-go"
+)
+
+var quoted = regexp.MustCompile(`"([^"]+)"`)
+
+var rating = regexp.MustCompile(`(?m)^\D*(\d+)\s*[:=-]\s*(\d+(?:\.\d+)?)`)
+
+// mmr selects n results balancing relevance against diversity, a lambda of 1
+// ranks by relevance only.
+func mmr(res []chromem.Result, n int, lambda float64) []chromem.Result {
+	var sel []chromem.Result
+
+	left := res
+
+	for len(sel) < n && len(left) > 0 {
+		best, score := 0, math.Inf(-1)
+
+		for i, r := range left {
+			var sim float64
+
+			for _, s := range sel {
+				sim = max(sim, dot(r.Embedding, s.Embedding))
+			}
+
+			if v := lambda*float64(r.Similarity) - (1-lambda)*sim; v > score {
+				best, score = i, v
+			}
+		}
+
+		sel = append(sel, left[best])
+		left = append(left[:best:best], left[best+1:]...)
+	}
+
+	return sel
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+
+	for i := range min(len(a), len(b)) {
+		sum += float64(a[i] * b[i]) // normalized
+	}
+
+	return sum
+}
+
+// terms returns the quoted tokens of the query, or the tokens looking like
+// identifiers (addresses, sids, hostnames) if nothing is quoted.
+func terms(query string) []string {
+	var res []string
+
+	for _, m := range quoted.FindAllStringSubmatch(query, -1) {
+		res = append(res, m[1])
+	}
+
+	if len(res) > 0 {
+		return res
+	}
+
+	for _, f := range strings.Fields(query) {
+		f = strings.TrimRight(strings.Trim(f, "?!,;:()[]'`"), ".")
+
+		if len(f) < 3 {
+			continue
+		}
+
+		if strings.ContainsFunc(f, unicode.IsDigit) || strings.ContainsAny(f[1:len(f)-1], `.\_-@`) {
+			res = append(res, f)
+		}
+	}
+
+	return res
+}
+
+func containing(res []chromem.Result, terms []string) []chromem.Result {
+	return slices.DeleteFunc(res, func(r chromem.Result) bool {
+		for _, t := range terms {
+			if !strings.Contains(r.Content, t) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// unique collapses results with the same content, keeping the most similar.
+func unique(res []chromem.Result) ([]chromem.Result, int) {
+	n := len(res)
+	seen := make(map[string]bool, n)
+
+	res = slices.DeleteFunc(res, func(r chromem.Result) bool {
+		if seen[r.Content] {
+			return true
+		}
+
+		seen[r.Content] = true
+
+		return false
+	})
+
+	return res, n - len(res)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func invalid(err error) int {
+	var mbe *http.MaxBytesError
+
+	if errors.As(err, &mbe) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+func status(err error) int {
+	switch {
+	case errors.Is(err, errBusy):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errModel):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+func envelope(c *gin.Context, code int, err error) Failure {
+	return Failure{
+		Error: Error{
+			Code:      strings.ReplaceAll(strings.ToLower(http.StatusText(code)), " ", "_"),
+			Message:   err.Error(),
+			RequestID: c.Writer.Header().Get("X-Request-ID"),
+		},
+	}
+}
+
+func fail(c *gin.Context, code int, err error) {
+	c.AbortWithStatusJSON(code, envelope(c, code, err))
+}
+
+func (s *Server) reader(c *gin.Context) (io.Reader, error) {
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(c.Request.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return http.MaxBytesReader(c.Writer, gz, s.cfg.MaxBody), nil // decompressed
+	}
+
+	return c.Request.Body, nil
+}
+
+func lineFormat(c *gin.Context) (string, error) {
+	f := c.DefaultQuery("format", "cef")
+
+	if !slices.Contains([]string{"cef", "syslog", "json"}, f) {
+		return "", errors.New("invalid format")
+	}
+
+	return f, nil
+}
+
+// snapshotFile resolves the ?file= parameter inside the snapshot directory.
+func (s *Server) snapshotFile(c *gin.Context) (string, error) {
+	name := c.DefaultQuery("file", s.collection(c)+".snapshot")
+
+	if name != filepath.Base(name) || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+		return "", errors.New("invalid file")
+	}
+
+	return filepath.Join(s.cfg.Snapshots, name), nil
+}
+
+func bound(c *gin.Context, key string) (*time.Time, error) {
+	v, ok := c.GetQuery(key)
+
+	if !ok {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (s *Server) defaults(c *gin.Context) Question {
+	return Question{
+		Case:       s.collection(c),
+		TopK:       s.cfg.TopK,
+		NumCtx:     s.cfg.NumCtx,
+		NumPredict: s.cfg.NumPredict,
+		Debug:      s.cfg.Debug,
+	}
+}
+
+func (s *Server) question(c *gin.Context) (Question, error) {
+	body, err := io.ReadAll(c.Request.Body)
+
+	if err != nil {
+		return Question{}, err
+	}
+
+	q := s.defaults(c)
+
+	q.Query = string(body)
+
+	if v, ok := c.GetQuery("debug"); ok {
+		q.Debug, err = strconv.ParseBool(v)
+
+		if err != nil {
+			return q, errors.New("invalid debug")
+		}
+	}
+
+	if v, ok := c.GetQuery("stateless"); ok {
+		q.Stateless, err = strconv.ParseBool(v)
+
+		if err != nil {
+			return q, errors.New("invalid stateless")
+		}
+	}
+
+	if c.Request.Method == http.MethodGet {
+		q.Query = c.Query("q")
+	}
+
+	q.Mode = c.Query("mode")
+
+	if v, ok := c.GetQuery("n"); ok {
+		q.TopK, err = strconv.Atoi(v)
+
+		if err != nil {
+			return q, errors.New("invalid n")
+		}
+	}
+
+	q.From, err = bound(c, "from")
+
+	if err != nil {
+		return q, err
+	}
+
+	q.To, err = bound(c, "to")
+
+	if err != nil {
+		return q, err
+	}
+
+	if c.ContentType() == gin.MIMEJSON {
+		q.Query = ""
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+
+		err = dec.Decode(&q)
+
+		if err != nil {
+			return q, err
+		}
+
+		if len(q.Case) == 0 {
+			q.Case = s.cfg.Collection
+		}
+	}
+
+	return q, s.validate(q)
+}
+
+func (s *Server) validate(q Question) error {
+	for k := range q.Where {
+		if _, ok := s.keys.Load(k); !ok {
+			return fmt.Errorf("unknown filter key %s", k)
+		}
+	}
+
+	if len(strings.TrimSpace(q.Query)) == 0 {
+		return errors.New("a question is required")
+	}
+
+	if q.TopK < 1 {
+		return errors.New("invalid topk")
+	}
+
+	if q.NumCtx < 1 {
+		return errors.New("invalid num_ctx")
+	}
+
+	if q.NumPredict < 0 {
+		return errors.New("invalid num_predict")
+	}
+
+	if !slices.Contains([]string{"", "vector", "hybrid"}, q.Mode) {
+		return errors.New("invalid mode")
+	}
+
+	if q.Timeout != nil && q.Timeout.Duration <= 0 {
+		return errors.New("invalid timeout")
+	}
+
+	if q.N < 0 || q.N > Choices {
+		return fmt.Errorf("n must be between 1 and %d", Choices)
+	}
+
+	return nil
+}
+
+func (t *Timeout) UnmarshalJSON(b []byte) error {
+	var v any
+
+	err := json.Unmarshal(b, &v)
+
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		t.Duration = time.Duration(v * float64(time.Second))
+	case string:
+		t.Duration, err = time.ParseDuration(v)
+	default:
+		err = errors.New("invalid timeout")
+	}
+
+	return err
+}
+
+func page(c *gin.Context, limit int) (int, int, error) {
+	var offset int
+	var err error
+
+	if v, ok := c.GetQuery("limit"); ok {
+		limit, err = strconv.Atoi(v)
+
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+
+	if v, ok := c.GetQuery("offset"); ok {
+		offset, err = strconv.Atoi(v)
+
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+
+	return min(limit, Limit), offset, nil
+}
+
+func (s *Server) collection(c *gin.Context) string {
+	return c.DefaultQuery("case", s.cfg.Collection)
+}
+
+func session(c *gin.Context) string {
+	if id := c.GetHeader("X-Session-ID"); len(id) > 0 {
+		return id
+	}
+
+	return Session
+}
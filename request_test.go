@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	s := &Server{}
+
+	for _, tc := range []struct {
+		body string
+		want time.Duration
+		ok   bool
+	}{
+		{`{"timeout": 30}`, 30 * time.Second, true},
+		{`{"timeout": "1m"}`, time.Minute, true},
+		{`{"timeout": -1}`, -time.Second, false},
+		{`{"timeout": "-1s"}`, -time.Second, false},
+		{`{"timeout": 0}`, 0, false},
+	} {
+		q := Question{Query: "q", TopK: 1, NumCtx: 1}
+
+		err := json.Unmarshal([]byte(tc.body), &q)
+
+		if err != nil {
+			t.Fatalf("%s: %v", tc.body, err)
+		}
+
+		if q.Timeout.Duration != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.body, q.Timeout.Duration, tc.want)
+		}
+
+		if err = s.validate(q); (err == nil) != tc.ok {
+			t.Errorf("%s: validate returned %v", tc.body, err)
+		}
+	}
+}
@@ -0,0 +1,1188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/api"
+	"github.com/philippgille/chromem-go"
+	"golang.org/x/time/rate"
+)
+
+var inflight = expvar.NewInt("queries_inflight")
+var hits = expvar.NewInt("cache_hits")
+var expired = expvar.NewInt("events_expired")
+var errBusy = errors.New("too many queries")
+var errEmpty = errors.New(Empty)
+var errModel = errors.New("model not found")
+
+type Config struct {
+	Collection  string
+	Model       string
+	Embed       string
+	DB          string
+	Prompt      string
+	Template    *template.Template
+	Key         string
+	Origins     []string
+	Proxies     []string
+	Fields      map[string]string
+	Snapshots   string
+	MaxBody     int64
+	Similarity  float64
+	Debug       bool
+	MapReduce   bool
+	Rerank      bool
+	Lambda      float64
+	Rate        float64
+	Burst       int
+	TopK        int
+	NumCtx      int
+	NumPredict  int
+	Temperature float64
+	Seed        int
+	SampleTopK  int
+	SampleTopP  float64
+	Budget      int
+	Retries     int
+	Timeout     time.Duration
+	Parallel    int
+	Turns       int
+	Buffer      int
+	Batch       int
+	Flush       time.Duration
+	Progress    int
+	Workers     int
+	Hash        string
+	MaxEvents   int
+	TTL         time.Duration
+	KeepAlive   time.Duration
+}
+
+type Server struct {
+	cfg         Config
+	client      Client
+	db          *chromem.DB
+	engine      *gin.Engine
+	embed       chromem.EmbeddingFunc
+	events      chan Event
+	done        chan struct{}
+	slots       chan struct{}
+	sessions    map[string][]api.Message
+	used        map[string]time.Time
+	keepAlive   *api.Duration
+	collections sync.Map
+	ledgers     sync.Map
+	mutex       sync.Mutex
+	lock        sync.RWMutex
+	wg          sync.WaitGroup
+	ready       atomic.Bool
+	limiters    sync.Map
+	cache       sync.Map
+	keys        sync.Map
+	formats     sync.Map
+	ingested    atomic.Int64
+	pending     atomic.Int64
+	probe       struct {
+		sync.Mutex
+		err error
+		at  time.Time
+	}
+	check struct {
+		sync.Mutex
+		err error
+		at  time.Time
+	}
+	listing struct {
+		sync.Mutex
+		res *api.ListResponse
+		err error
+		at  time.Time
+	}
+	started time.Time
+	latency struct {
+		sync.Mutex
+		n      int64
+		sum    time.Duration
+		window []time.Duration
+	}
+	meter struct {
+		sync.Mutex
+		count int64
+		at    time.Time
+	}
+}
+
+func NewServer(cfg Config, client Client) (*Server, error) {
+	var err error
+
+	s := &Server{
+		cfg:       cfg,
+		client:    client,
+		engine:    gin.New(),
+		embed:     embedding(client, cfg.Embed),
+		events:    make(chan Event, cfg.Buffer),
+		done:      make(chan struct{}),
+		slots:     make(chan struct{}, cfg.Parallel),
+		sessions:  make(map[string][]api.Message),
+		used:      make(map[string]time.Time),
+		keepAlive: &api.Duration{Duration: cfg.KeepAlive},
+		started:   time.Now(),
+	}
+
+	if len(cfg.DB) > 0 {
+		s.db, err = chromem.NewPersistentDB(cfg.DB, false)
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.db = chromem.NewDB()
+	}
+
+	_, err = s.open(cfg.Collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range s.db.ListCollections() {
+		s.get(name)
+
+		docs, err := s.scan(name)
+
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %w", name, err)
+		}
+
+		for _, doc := range docs {
+			s.ledger(name).push(doc.ID)
+			s.learn(doc.Metadata)
+			s.note(name, doc.Metadata)
+		}
+	}
+
+	for range cfg.Workers {
+		s.wg.Go(func() {
+			s.consume()
+		})
+	}
+
+	if cfg.TTL > 0 {
+		s.wg.Go(func() {
+			s.expire()
+		})
+	}
+
+	if cfg.Rate > 0 {
+		s.wg.Go(func() {
+			s.sweep()
+		})
+	}
+
+	// without trusted proxies X-Forwarded-For is ignored
+	err = s.engine.SetTrustedProxies(cfg.Proxies)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.routes()
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.engine.ServeHTTP(w, r)
+}
+
+// Close drains the ingest queue after the http server has shut down.
+func (s *Server) Close() {
+	close(s.events)
+	close(s.done)
+
+	s.wg.Wait()
+}
+
+func (s *Server) routes() {
+	s.engine.Use(identify(), logger(), gin.CustomRecoveryWithWriter(io.Discard, recovery))
+
+	s.engine.Use(limit(s.cfg.MaxBody))
+
+	if len(s.cfg.Origins) > 0 {
+		s.engine.Use(cors(s.cfg.Origins))
+	}
+
+	if len(s.cfg.Key) > 0 {
+		s.engine.Use(auth(s.cfg.Key))
+	}
+
+	s.engine.NoRoute(func(c *gin.Context) {
+		fail(c, http.StatusNotFound, errors.New("not found"))
+	})
+
+	throttle := s.throttle(rate.Limit(s.cfg.Rate), s.cfg.Burst)
+
+	s.engine.GET("/healthz", s.healthz)
+	s.engine.GET("/ready", s.readyz)
+	s.engine.GET("/version", s.version)
+	s.engine.GET("/metrics", gin.WrapH(expvar.Handler()))
+	s.engine.GET("/stats", s.stats)
+	s.engine.GET("/models", s.getModels)
+	s.engine.GET("/ingest/status", s.ingestStatus)
+	s.engine.GET("/event", s.countEvents)
+	s.engine.POST("/event", throttle, s.postEvents)
+	s.engine.POST("/upload", throttle, s.upload)
+	s.engine.DELETE("/events", s.deleteEvents)
+	s.engine.POST("/events/delete", s.purgeEvents)
+	s.engine.PUT("/event/:id", s.putEvent)
+	s.engine.DELETE("/event/:id", s.deleteEvent)
+	s.engine.GET("/export", s.exportEvents)
+	s.engine.POST("/snapshot", s.postSnapshot)
+	s.engine.POST("/restore", s.postRestore)
+	s.engine.POST("/import", s.importEvents)
+	s.engine.GET("/history", s.getHistory)
+	s.engine.DELETE("/history", s.deleteHistory)
+	s.engine.POST("/embed", s.postEmbed)
+	s.engine.POST("/reindex", s.postReindex)
+	s.engine.POST("/summarize", s.postSummarize)
+	s.engine.GET("/search", s.search)
+	s.engine.POST("/search", s.search)
+	s.engine.GET("/query", throttle, s.ask)
+	s.engine.POST("/query", throttle, s.ask)
+	s.engine.GET("/ws", throttle, s.chat)
+}
+
+func (s *Server) version(c *gin.Context) {
+	c.JSON(http.StatusOK, Version{
+		Version: version,
+		Commit:  commit,
+		Model:   s.cfg.Model,
+		Embed:   s.cfg.Embed,
+	})
+}
+
+func (s *Server) getModels(c *gin.Context) {
+	res, err := s.list(c.Request.Context())
+
+	if err != nil {
+		fail(c, http.StatusServiceUnavailable, fmt.Errorf("ollama unreachable: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+func (s *Server) readyz(c *gin.Context) {
+	s.lock.RLock()
+	col := s.get(s.cfg.Collection)
+	s.lock.RUnlock()
+
+	if !s.ready.Load() || col == nil {
+		fail(c, http.StatusServiceUnavailable, errors.New("not ready"))
+		return
+	}
+
+	if err := s.reachable(c.Request.Context()); err != nil {
+		fail(c, http.StatusServiceUnavailable, fmt.Errorf("ollama unreachable: %w", err))
+		return
+	}
+
+	if err := s.queryable(c.Request.Context()); err != nil {
+		fail(c, http.StatusServiceUnavailable, fmt.Errorf("database unhealthy: %w", err))
+		return
+	}
+
+	c.String(http.StatusOK, "ready")
+}
+
+func (s *Server) stats(c *gin.Context) {
+	var n int
+
+	name := s.collection(c)
+
+	s.lock.RLock()
+	col := s.get(name)
+	s.lock.RUnlock()
+
+	if col != nil {
+		n = col.Count()
+	}
+
+	s.latency.Lock()
+
+	res := Stats{
+		Ingested:   s.ingested.Load(),
+		Count:      n,
+		Collection: name,
+		Queries:    s.latency.n,
+		Uptime:     time.Since(s.started).Round(time.Second).String(),
+	}
+
+	if s.latency.n > 0 {
+		res.Average = float64(s.latency.sum) / float64(s.latency.n) / float64(time.Millisecond)
+	}
+
+	if len(s.latency.window) > 0 {
+		window := slices.Clone(s.latency.window)
+
+		slices.Sort(window)
+
+		res.P95 = float64(window[(len(window)*95-1)/100]) / float64(time.Millisecond)
+	}
+
+	s.latency.Unlock()
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) ingestStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, Status{
+		Queued:   len(s.events),
+		Indexed:  s.ingested.Load(),
+		Inflight: s.pending.Load() > 0, // batched, not yet indexed
+	})
+}
+
+// observe records the latency of a served query.
+func (s *Server) observe(d time.Duration) {
+	s.latency.Lock()
+	defer s.latency.Unlock()
+
+	s.latency.n++
+	s.latency.sum += d
+
+	if len(s.latency.window) == Window {
+		s.latency.window = s.latency.window[1:]
+	}
+
+	s.latency.window = append(s.latency.window, d)
+}
+
+func (s *Server) countEvents(c *gin.Context) {
+	var n int
+
+	if _, ok := c.GetQuery("probe"); ok {
+		s.probeEvents(c)
+		return
+	}
+
+	name := s.collection(c)
+
+	s.lock.RLock()
+	col := s.get(name)
+	s.lock.RUnlock()
+
+	if col != nil {
+		n = col.Count()
+	}
+
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusOK, Count{
+			Count:      n,
+			Collection: name,
+		})
+		return
+	}
+
+	count := fmt.Sprintf("%d events", n)
+
+	c.String(http.StatusOK, count)
+}
+
+// probeEvents returns the nearest neighbors of the probe without content.
+func (s *Server) probeEvents(c *gin.Context) {
+	n, err := strconv.Atoi(c.DefaultQuery("n", "5"))
+
+	if err != nil || n < 1 {
+		fail(c, http.StatusBadRequest, errors.New("invalid n"))
+		return
+	}
+
+	probe := c.Query("probe")
+
+	if len(strings.TrimSpace(probe)) == 0 {
+		fail(c, http.StatusBadRequest, errors.New("a probe is required"))
+		return
+	}
+
+	res, err := s.retrieve(c.Request.Context(), Question{
+		Query: probe,
+		Case:  s.collection(c),
+		TopK:  n,
+	})
+
+	if errors.Is(err, errEmpty) {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	if err != nil {
+		fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	neighbors := make([]Neighbor, 0, len(res))
+
+	for _, r := range res {
+		neighbors = append(neighbors, Neighbor{
+			ID:         r.ID,
+			Similarity: r.Similarity,
+		})
+	}
+
+	c.JSON(http.StatusOK, neighbors)
+}
+
+func (s *Server) postEvents(c *gin.Context) {
+	r, err := s.reader(c)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	body, err := io.ReadAll(r)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		fail(c, http.StatusBadRequest, errors.New("an event is required"))
+		return
+	}
+
+	name := s.collection(c)
+
+	format, err := lineFormat(c)
+
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+
+	n, rejected, err := s.enqueue(c.Request.Context(), name, format, string(body))
+
+	if err != nil {
+		fail(c, http.StatusTooManyRequests, err)
+		return
+	}
+
+	logs(c.Request.Context()).Info("ingest", "case", name, "format", format, "events", n, "rejected", rejected)
+
+	count := fmt.Sprintf("%d events", n)
+
+	if rejected > 0 {
+		count += fmt.Sprintf(", %d rejected", rejected)
+	}
+
+	c.String(http.StatusOK, count)
+}
+
+func (s *Server) upload(c *gin.Context) {
+	form, err := c.MultipartForm()
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	name := s.collection(c)
+
+	format, err := lineFormat(c)
+
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res := []Upload{}
+
+	for _, field := range slices.Sorted(maps.Keys(form.File)) {
+		for _, fh := range form.File[field] {
+			f, err := fh.Open()
+
+			if err != nil {
+				fail(c, http.StatusInternalServerError, err)
+				return
+			}
+
+			body, err := io.ReadAll(f)
+
+			f.Close()
+
+			if err != nil {
+				fail(c, invalid(err), err)
+				return
+			}
+
+			n, rejected, err := s.enqueue(c.Request.Context(), name, format, string(body))
+
+			if err != nil {
+				fail(c, http.StatusTooManyRequests, fmt.Errorf("%s: %w", fh.Filename, err))
+				return
+			}
+
+			logs(c.Request.Context()).Info("upload", "case", name, "file", fh.Filename, "format", format, "events", n, "rejected", rejected)
+
+			res = append(res, Upload{
+				File:     fh.Filename,
+				Events:   n,
+				Rejected: rejected,
+			})
+		}
+	}
+
+	if len(res) == 0 {
+		fail(c, http.StatusBadRequest, errors.New("a file is required"))
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// enqueue parses the lines in the given format and queues them for ingestion.
+func (s *Server) enqueue(ctx context.Context, name, format, body string) (n, rejected int, err error) {
+	for line := range strings.Lines(body) {
+		if line = strings.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+
+		event := Event{
+			Case:    name,
+			Content: line,
+		}
+
+		switch format {
+		case "syslog":
+			event.Metadata, event.Content = syslog(line)
+			event.ID = s.id(line) // same message, other time
+		case "json":
+			event.Metadata, event.Content = jsonl(line, s.cfg.Fields)
+		}
+
+		if format != "cef" && (event.Metadata == nil || len(event.Content) == 0) {
+			rejected++
+			continue
+		}
+
+		select {
+		case s.events <- event:
+			n++
+		default:
+			logs(ctx).Warn("queue full", "case", name, "events", n, "buffer", cap(s.events))
+			return n, rejected, fmt.Errorf("queue full after %d events", n)
+		}
+	}
+
+	return n, rejected, nil
+}
+
+func (s *Server) postSnapshot(c *gin.Context) {
+	name := s.collection(c)
+
+	if len(s.cfg.Snapshots) == 0 {
+		fail(c, http.StatusForbidden, errors.New("snapshots are disabled"))
+		return
+	}
+
+	path, err := s.snapshotFile(c)
+
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+
+	n, err := s.snapshot(c.Request.Context(), name, path)
+
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	logs(c.Request.Context()).Info("snapshot", "case", name, "file", path, "events", n)
+
+	c.JSON(http.StatusOK, Snapshot{
+		File:   filepath.Base(path),
+		Events: n,
+	})
+}
+
+func (s *Server) postRestore(c *gin.Context) {
+	name := s.collection(c)
+
+	if len(s.cfg.Snapshots) == 0 {
+		fail(c, http.StatusForbidden, errors.New("snapshots are disabled"))
+		return
+	}
+
+	path, err := s.snapshotFile(c)
+
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+
+	n, err := s.restore(c.Request.Context(), name, path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		fail(c, http.StatusNotFound, errors.New("snapshot not found"))
+		return
+	}
+
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	logs(c.Request.Context()).Info("restore", "case", name, "file", path, "events", n)
+
+	c.JSON(http.StatusOK, Snapshot{
+		File:   filepath.Base(path),
+		Events: n,
+	})
+}
+
+func (s *Server) deleteEvents(c *gin.Context) {
+	var n int
+
+	name := s.collection(c)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if col := s.get(name); col != nil {
+		n = col.Count()
+	}
+
+	_, err := s.recreate(name)
+
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	count := fmt.Sprintf("%d events", n)
+
+	c.String(http.StatusOK, count)
+}
+
+func (s *Server) deleteEvent(c *gin.Context) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	col := s.get(s.collection(c))
+
+	id := c.Param("id")
+
+	if col == nil {
+		fail(c, http.StatusNotFound, errors.New("event not found"))
+		return
+	}
+
+	_, err := col.GetByID(c.Request.Context(), id)
+
+	if err != nil {
+		fail(c, http.StatusNotFound, errors.New("event not found"))
+		return
+	}
+
+	err = col.Delete(c.Request.Context(), nil, nil, id)
+
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.ledger(s.collection(c)).remove(id)
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) purgeEvents(c *gin.Context) {
+	var ids []string
+
+	err := c.ShouldBindJSON(&ids)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	res := Purge{
+		Missing: make([]string, 0),
+	}
+
+	// no adds in between
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	col := s.get(s.collection(c))
+
+	var found []string
+
+	for _, id := range ids {
+		if col == nil || len(id) == 0 {
+			res.Missing = append(res.Missing, id)
+		} else if _, err := col.GetByID(c.Request.Context(), id); err != nil {
+			res.Missing = append(res.Missing, id)
+		} else if !slices.Contains(found, id) {
+			found = append(found, id)
+		}
+	}
+
+	if len(found) > 0 {
+		err = col.Delete(c.Request.Context(), nil, nil, found...)
+
+		if err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		s.ledger(s.collection(c)).remove(found...)
+	}
+
+	res.Deleted = len(found)
+
+	logs(c.Request.Context()).Info("purge", "case", s.collection(c), "deleted", res.Deleted, "missing", len(res.Missing))
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) putEvent(c *gin.Context) {
+	r, err := s.reader(c)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	body, err := io.ReadAll(r)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	content := strings.TrimSpace(string(body))
+
+	if len(content) == 0 {
+		fail(c, http.StatusBadRequest, errors.New("an event is required"))
+		return
+	}
+
+	var emb []float32 // before locking, embedding is slow
+
+	err = s.retry(c.Request.Context(), func() (err error) {
+		emb, err = s.embed(c.Request.Context(), content)
+		return
+	})
+
+	if err != nil {
+		fail(c, status(err), err)
+		return
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	col := s.get(s.collection(c))
+
+	id := c.Param("id")
+
+	if col == nil {
+		fail(c, http.StatusNotFound, errors.New("event not found"))
+		return
+	}
+
+	old, err := col.GetByID(c.Request.Context(), id)
+
+	if err != nil {
+		fail(c, http.StatusNotFound, errors.New("event not found"))
+		return
+	}
+
+	meta := old.Metadata // syslog and json headers are not part of the content
+
+	if f, ok := old.Metadata["format"]; !ok || f == "cef" {
+		meta = cef(content)
+
+		if v, ok := old.Metadata["ingested"]; ok {
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+
+			meta["ingested"] = v // keep order
+		}
+	}
+
+	s.learn(meta)
+
+	err = col.AddDocument(c.Request.Context(), chromem.Document{
+		ID:        id, // stable
+		Metadata:  meta,
+		Content:   content,
+		Embedding: emb,
+	})
+
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Record{
+		ID:      id,
+		Content: content,
+	})
+}
+
+func (s *Server) exportEvents(c *gin.Context) {
+	c.Header("Content-Type", "application/x-ndjson")
+
+	enc := json.NewEncoder(c.Writer)
+
+	// written while iterating, the response has started on errors
+	err := s.each(c.Request.Context(), s.collection(c), func(doc chromem.Document) error {
+		return enc.Encode(Record{
+			ID:       doc.ID,
+			Content:  doc.Content,
+			Metadata: doc.Metadata,
+		})
+	})
+
+	if err != nil {
+		logs(c.Request.Context()).Warn("export aborted", "error", err) // client gone
+	}
+}
+
+func (s *Server) importEvents(c *gin.Context) {
+	r, err := s.reader(c)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		fh, err := c.FormFile("file")
+
+		if err != nil {
+			fail(c, invalid(err), err)
+			return
+		}
+
+		f, err := fh.Open()
+
+		if err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	var res Import
+
+	name := s.collection(c)
+
+	dec := json.NewDecoder(r)
+
+	for {
+		var rec Record
+
+		err = dec.Decode(&rec)
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			fail(c, invalid(err), err)
+			return
+		}
+
+		if len(strings.TrimSpace(rec.Content)) == 0 && len(rec.Embedding) == 0 {
+			res.Skipped++ // nothing to embed
+			continue
+		}
+
+		var ok bool
+
+		err = s.retry(c.Request.Context(), func() (err error) {
+			ok, err = s.add(c.Request.Context(), Event{
+				Case:      name,
+				ID:        rec.ID,
+				Content:   rec.Content,
+				Metadata:  rec.Metadata,
+				Embedding: rec.Embedding,
+			})
+			return
+		})
+
+		if err != nil {
+			fail(c, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		if ok {
+			res.Imported++
+		} else {
+			res.Skipped++
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) getHistory(c *gin.Context) {
+	n := math.MaxInt
+
+	if v, ok := c.GetQuery("truncate"); ok {
+		var err error
+
+		n, err = strconv.Atoi(v)
+
+		if err != nil || n < 0 {
+			fail(c, http.StatusBadRequest, errors.New("invalid truncate"))
+			return
+		}
+	}
+
+	msgs := make([]Message, 0)
+
+	for _, m := range s.messages(session(c)) {
+		content := m.Content
+
+		if len(content) > n {
+			content = truncate(content, n) + "..."
+		}
+
+		msgs = append(msgs, Message{
+			Role:    m.Role,
+			Content: content,
+		})
+	}
+
+	c.JSON(http.StatusOK, msgs)
+}
+
+func (s *Server) deleteHistory(c *gin.Context) {
+	count := fmt.Sprintf("%d messages", s.reset(session(c)))
+
+	c.String(http.StatusOK, count)
+}
+
+func (s *Server) postEmbed(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	texts := []string{string(body)}
+
+	batch := c.ContentType() == gin.MIMEJSON
+
+	if batch {
+		err = json.Unmarshal(body, &texts)
+
+		if err != nil {
+			fail(c, invalid(err), err)
+			return
+		}
+	}
+
+	vectors := make([][]float32, 0, len(texts))
+
+	for _, text := range texts {
+		var v []float32
+
+		err = s.retry(c.Request.Context(), func() (err error) {
+			v, err = s.embed(c.Request.Context(), text)
+			return
+		})
+
+		if err != nil {
+			fail(c, status(err), err)
+			return
+		}
+
+		vectors = append(vectors, v)
+	}
+
+	if batch {
+		c.JSON(http.StatusOK, vectors)
+	} else {
+		c.JSON(http.StatusOK, vectors[0])
+	}
+}
+
+func (s *Server) postReindex(c *gin.Context) {
+	name := s.collection(c)
+
+	logs(c.Request.Context()).Info("reindex", "case", name, "embed", s.cfg.Embed)
+
+	n, err := s.reindex(c.Request.Context(), name)
+
+	if err != nil {
+		fail(c, status(err), err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reindexed": n,
+	})
+}
+
+func (s *Server) postSummarize(c *gin.Context) {
+	summary, err := s.summarize(c.Request.Context(), s.collection(c))
+
+	if err != nil {
+		fail(c, status(err), err)
+		return
+	}
+
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusOK, gin.H{
+			"summary": summary,
+		})
+	} else {
+		c.String(http.StatusOK, summary)
+	}
+}
+
+func (s *Server) search(c *gin.Context) {
+	q, err := s.question(c)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	limit, offset, err := page(c, q.TopK)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	q.TopK = math.MaxInt // rank all
+
+	res, err := s.retrieve(c.Request.Context(), q)
+
+	if errors.Is(err, errEmpty) {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	if err != nil {
+		fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	total := len(res)
+
+	offset = min(offset, total)
+
+	res = res[offset:min(offset+limit, total)]
+
+	sources := make([]Source, 0, len(res))
+
+	for _, r := range res {
+		sources = append(sources, Source{
+			ID:         r.ID,
+			Content:    r.Content,
+			Similarity: r.Similarity,
+		})
+	}
+
+	c.JSON(http.StatusOK, Page{
+		Results: sources,
+		Total:   total,
+		Offset:  offset,
+	})
+}
+
+func (s *Server) ask(c *gin.Context) {
+	q, err := s.question(c)
+
+	if err != nil {
+		fail(c, invalid(err), err)
+		return
+	}
+
+	start := time.Now()
+
+	accept := c.GetHeader("Accept")
+
+	if strings.Contains(accept, "text/event-stream") {
+		if q.N > 1 {
+			fail(c, http.StatusBadRequest, errors.New("multiple answers can not be streamed"))
+			return
+		}
+
+		_, err = s.query(c.Request.Context(), session(c), q, func(chunk string) {
+			if len(chunk) == 0 {
+				return // final
+			}
+
+			c.SSEvent("", chunk)
+			c.Writer.Flush()
+		})
+
+		switch {
+		case err == nil:
+			s.observe(time.Since(start))
+			c.SSEvent("done", "")
+		case c.Writer.Written():
+			c.SSEvent("error", envelope(c, status(err), err))
+		default:
+			fail(c, status(err), err)
+		}
+
+		c.Writer.Flush()
+		return
+	}
+
+	answer, err := s.query(c.Request.Context(), session(c), q, nil)
+
+	if err != nil {
+		fail(c, status(err), err)
+		return
+	}
+
+	s.observe(time.Since(start))
+
+	if strings.Contains(accept, "application/json") {
+		c.JSON(http.StatusOK, answer)
+	} else {
+		c.String(http.StatusOK, answer.Answer)
+	}
+}
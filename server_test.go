@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// config returns the flag defaults, tests change what they need.
+func config() Config {
+	return Config{
+		Collection:  Collection,
+		Model:       Model,
+		Embed:       Embed,
+		MaxBody:     32 << 20,
+		Lambda:      1,
+		Burst:       10,
+		TopK:        20,
+		NumCtx:      Ctx,
+		Temperature: 0.2,
+		Seed:        8211,
+		SampleTopK:  10,
+		SampleTopP:  0.5,
+		Retries:     1,
+		Timeout:     2 * time.Minute,
+		Parallel:    4,
+		Turns:       10,
+		Buffer:      4096,
+		Batch:       64,
+		Flush:       10 * time.Millisecond,
+		Workers:     1,
+		Hash:        "xxh3",
+	}
+}
+
+func server(t *testing.T, cfg Config, client Client) *Server {
+	t.Helper()
+
+	s, err := NewServer(cfg, client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Close)
+
+	return s
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// history returns the conversation of the session so far.
+func (s *Server) history(session, name string) []api.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.sessions[session]) == 0 {
+		return []api.Message{{
+			Role:    "System",
+			Content: s.system(name),
+		}}
+	}
+
+	return slices.Clone(s.sessions[session]) // snapshot
+}
+
+// remember appends the turns of an answered question, failed questions are
+// not part of the conversation.
+func (s *Server) remember(session, name string, turns ...api.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.sessions[session]) == 0 {
+		s.forget()
+
+		s.sessions[session] = []api.Message{{
+			Role:    "System",
+			Content: s.system(name),
+		}}
+	}
+
+	s.sessions[session] = append(s.sessions[session], turns...)
+	s.used[session] = time.Now()
+
+	if keep := 2 * s.cfg.Turns; len(s.sessions[session]) > keep+1 {
+		s.sessions[session] = slices.Delete(s.sessions[session], 1, len(s.sessions[session])-keep) // keep prompt
+	}
+}
+
+func (s *Server) messages(session string) []api.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.sessions[session])
+}
+
+func (s *Server) reset(session string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := max(len(s.sessions[session])-1, 0) // keep prompt
+
+	delete(s.sessions, session)
+	delete(s.used, session)
+
+	return n
+}
+
+// forget drops idle sessions and the least recently used one above the
+// limit, session ids are chosen by clients. Callers hold the mutex.
+func (s *Server) forget() {
+	now := time.Now()
+
+	for id, at := range s.used {
+		if now.Sub(at) > Idle {
+			delete(s.sessions, id)
+			delete(s.used, id)
+		}
+	}
+
+	if len(s.sessions) < Sessions {
+		return
+	}
+
+	oldest := slices.MinFunc(slices.Collect(maps.Keys(s.used)), func(a, b string) int {
+		return s.used[a].Compare(s.used[b])
+	})
+
+	delete(s.sessions, oldest)
+	delete(s.used, oldest)
+}
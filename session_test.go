@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestSessionsBounded(t *testing.T) {
+	s := server(t, config(), &fake{})
+
+	turn := api.Message{Role: "User", Content: "question"}
+
+	for i := range Sessions + 10 {
+		s.remember(fmt.Sprint(i), Collection, turn)
+	}
+
+	if n := len(s.sessions); n != Sessions {
+		t.Errorf("expected %d sessions, got %d", Sessions, n)
+	}
+
+	if len(s.messages("0")) != 0 || len(s.messages(fmt.Sprint(Sessions+9))) == 0 {
+		t.Error("expected the least recently used sessions to be dropped")
+	}
+
+	s.used["10"] = time.Now().Add(-Idle - time.Minute)
+
+	s.remember("new", Collection, turn)
+
+	if len(s.messages("10")) != 0 {
+		t.Error("expected the idle session to be dropped")
+	}
+}
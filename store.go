@@ -0,0 +1,845 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+	"github.com/zeebo/xxh3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func (s *Server) consume() {
+	var batch []Event
+
+	embed := embedding(s.client, s.cfg.Embed) // per worker
+
+	ticker := time.NewTicker(s.cfg.Flush)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		var n int
+
+		ctx, sp := span(context.Background(), "ingest",
+			attribute.String("case", batch[len(batch)-1].Case),
+			attribute.Int("events", len(batch)),
+		)
+
+		err := s.retry(ctx, func() (err error) {
+			n, err = s.insert(ctx, embed, batch)
+			return
+		})
+
+		end(sp, err)
+
+		if err != nil {
+			slog.Error("ingest failed", "events", len(batch), "error", err)
+		}
+
+		s.progress(batch[len(batch)-1].Case, n)
+
+		if s.cfg.MaxEvents > 0 {
+			s.trim(batch)
+		}
+
+		s.pending.Add(-int64(len(batch)))
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				flush() // shutdown
+				return
+			}
+
+			s.pending.Add(1)
+
+			batch = append(batch, event)
+
+			if len(batch) >= s.cfg.Batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *Server) progress(name string, n int) {
+	every := int64(s.cfg.Progress)
+
+	if n == 0 {
+		return
+	}
+
+	s.meter.Lock()
+	defer s.meter.Unlock()
+
+	now := time.Now()
+
+	if s.meter.at.IsZero() {
+		s.meter.at = now // first batch
+	}
+
+	total := s.ingested.Add(int64(n))
+
+	if every == 0 || total/every == (total-int64(n))/every {
+		return
+	}
+
+	rate := float64(total-s.meter.count) / now.Sub(s.meter.at).Seconds()
+
+	s.meter.count, s.meter.at = total, now
+
+	var count int
+
+	s.lock.RLock()
+
+	if col := s.get(name); col != nil {
+		count = col.Count()
+	}
+
+	s.lock.RUnlock()
+
+	slog.Info("progress",
+		"case", name,
+		"events", count,
+		"ingested", total,
+		"rate", fmt.Sprintf("%.0f/s", rate),
+	)
+}
+
+// id derives the event id from its content, changing the algorithm on a
+// persistent database breaks the deduplication of already ingested events.
+func (s *Server) id(content string) string {
+	if s.cfg.Hash == "sha256" {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	}
+
+	return fmt.Sprintf("%x", xxh3.HashString(content))
+}
+
+// trim evicts the oldest events of the batch's collections above the cap.
+func (s *Server) trim(batch []Event) {
+	seen := make(map[string]bool)
+
+	for _, event := range batch {
+		if seen[event.Case] {
+			continue
+		}
+
+		seen[event.Case] = true
+
+		n, err := s.evict(context.Background(), event.Case)
+
+		if err != nil {
+			slog.Error("eviction failed", "case", event.Case, "error", err)
+		} else if n > 0 {
+			slog.Info("evicted", "case", event.Case, "events", n, "max", s.cfg.MaxEvents)
+		}
+	}
+}
+
+func (s *Server) evict(ctx context.Context, name string) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	col := s.get(name)
+
+	if col == nil || col.Count() <= s.cfg.MaxEvents {
+		return 0, nil
+	}
+
+	ids := s.ledger(name).oldest(col.Count() - s.cfg.MaxEvents)
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	for _, id := range ids {
+		if doc, err := col.GetByID(ctx, id); err == nil {
+			s.cache.Delete(xxh3.HashString(doc.Content)) // the cache follows the cap
+		}
+	}
+
+	err := col.Delete(ctx, nil, nil, ids...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.ledger(name).remove(ids...)
+
+	return len(ids), nil
+}
+
+// expire periodically deletes events with a timestamp older than the ttl,
+// events without a parseable timestamp or year are kept.
+func (s *Server) expire() {
+	ticker := time.NewTicker(min(s.cfg.TTL, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.lock.RLock()
+			names := slices.Sorted(maps.Keys(s.db.ListCollections()))
+			s.lock.RUnlock()
+
+			for _, name := range names {
+				n, err := s.prune(context.Background(), name, time.Now().Add(-s.cfg.TTL))
+
+				if err != nil {
+					slog.Error("expiry failed", "case", name, "error", err)
+				} else if n > 0 {
+					slog.Info("expired", "case", name, "events", n, "ttl", s.cfg.TTL)
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) prune(ctx context.Context, name string, before time.Time) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	col := s.get(name)
+
+	if col == nil {
+		return 0, nil
+	}
+
+	var ids []string
+
+	err := s.each(ctx, name, func(doc chromem.Document) error {
+		// without a year the age is unknown
+		if t, ok := stamp(doc.Metadata); ok && t.Year() != 0 && t.Before(before) {
+			ids = append(ids, doc.ID)
+			s.cache.Delete(xxh3.HashString(doc.Content))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	err = col.Delete(ctx, nil, nil, ids...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.ledger(name).remove(ids...)
+
+	expired.Add(int64(len(ids)))
+
+	return len(ids), nil
+}
+
+// queryable runs a canned query against the default collection, which
+// catches a corrupt database as well as a misconfigured embedding model.
+func (s *Server) queryable(ctx context.Context) error {
+	s.check.Lock()
+	defer s.check.Unlock()
+
+	if time.Since(s.check.at) < Probe {
+		return s.check.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, Probe)
+	defer cancel()
+
+	s.lock.RLock()
+	col := s.get(s.cfg.Collection)
+	s.lock.RUnlock()
+
+	switch {
+	case col == nil:
+		s.check.err = errors.New("collection not found")
+	case col.Count() == 0:
+		_, s.check.err = s.embed(ctx, "health") // nothing to query
+	default:
+		_, s.check.err = col.Query(ctx, "health", 1, nil, nil)
+	}
+
+	s.check.at = time.Now()
+
+	return s.check.err
+}
+
+// get returns the cached collection handle or nil, callers hold the lock.
+func (s *Server) get(name string) *chromem.Collection {
+	if v, ok := s.collections.Load(name); ok {
+		return v.(*chromem.Collection)
+	}
+
+	col := s.db.GetCollection(name, s.embed) // bind embedding
+
+	if col != nil {
+		s.collections.Store(name, col)
+	}
+
+	return col
+}
+
+func (s *Server) open(name string) (*chromem.Collection, error) {
+	if col := s.get(name); col != nil {
+		return col, nil
+	}
+
+	col, err := s.db.GetOrCreateCollection(name, nil, s.embed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.collections.Store(name, col)
+
+	return col, nil
+}
+
+// recreate empties the collection, callers hold the write lock.
+func (s *Server) recreate(name string) (*chromem.Collection, error) {
+	err := s.db.DeleteCollection(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.collections.Delete(name)
+
+	col, err := s.db.CreateCollection(name, nil, s.embed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.collections.Store(name, col)
+	s.ledgers.Store(name, newLedger())
+
+	return col, nil
+}
+
+// snapshot writes the events including their embeddings to the file.
+func (s *Server) snapshot(ctx context.Context, name, path string) (int, error) {
+	docs, err := s.documents(ctx, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(f.Name()) // after rename a no-op
+
+	gz := gzip.NewWriter(f)
+
+	err = errors.Join(gob.NewEncoder(gz).Encode(docs), gz.Close(), f.Close())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(docs), os.Rename(f.Name(), path) // atomic
+}
+
+// restore replaces the events of the collection with the events of the
+// file without embedding them again.
+func (s *Server) restore(ctx context.Context, name, path string) (int, error) {
+	var docs []chromem.Document
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = gob.NewDecoder(gz).Decode(&docs)
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the events are replaced in place, a cancellation must not stop halfway
+	ctx = context.WithoutCancel(ctx)
+
+	col, err := s.open(name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(docs) > 0 {
+		err = col.AddDocuments(ctx, docs, runtime.NumCPU()) // replaces by id
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	restored := newLedger()
+	keep := make(map[string]bool, len(docs))
+
+	for _, doc := range docs {
+		restored.push(doc.ID)
+		keep[doc.ID] = true
+
+		s.learn(doc.Metadata)
+		s.note(name, doc.Metadata)
+	}
+
+	var gone []string
+
+	for _, id := range s.ledger(name).ids() {
+		if !keep[id] {
+			gone = append(gone, id)
+		}
+	}
+
+	if len(gone) > 0 {
+		err = col.Delete(ctx, nil, nil, gone...)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	s.ledgers.Store(name, restored)
+
+	return len(docs), nil
+}
+
+func (s *Server) add(ctx context.Context, event Event) (bool, error) {
+	n, err := s.insert(ctx, s.embed, []Event{event})
+
+	return n > 0, err
+}
+
+func (s *Server) insert(ctx context.Context, embed chromem.EmbeddingFunc, events []Event) (int, error) {
+	var n int
+
+	docs, err := s.unseen(ctx, events)
+
+	if err != nil {
+		return n, err
+	}
+
+	for name, batch := range docs {
+		fresh, err := vectors(ctx, embed, batch) // unlocked, embedding is slow
+
+		if err != nil {
+			return n, err
+		}
+
+		err = s.store(ctx, name, batch)
+
+		if err != nil {
+			return n, err
+		}
+
+		n += len(batch)
+
+		for i, doc := range batch {
+			if fresh[i] {
+				s.cache.Store(xxh3.HashString(doc.Content), doc.Embedding)
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// unseen returns the events not yet ingested per collection.
+func (s *Server) unseen(ctx context.Context, events []Event) (map[string][]chromem.Document, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cols := make(map[string]*chromem.Collection)
+	docs := make(map[string][]chromem.Document)
+	seen := make(map[string]bool)
+
+	for _, event := range events {
+		col, ok := cols[event.Case]
+
+		if !ok {
+			var err error
+
+			col, err = s.open(event.Case)
+
+			if err != nil {
+				return nil, err
+			}
+
+			cols[event.Case] = col
+		}
+
+		hash := xxh3.HashString(event.Content)
+
+		id := event.ID
+
+		if len(id) == 0 {
+			id = s.id(event.Content)
+		}
+
+		if seen[event.Case+"/"+id] {
+			continue // same batch
+		}
+
+		seen[event.Case+"/"+id] = true
+
+		if _, err := col.GetByID(ctx, id); err == nil {
+			s.ledger(event.Case).push(id) // already ingested, maybe by a failed attempt
+			continue
+		}
+
+		emb := event.Embedding
+
+		if len(emb) == 0 {
+			if v, ok := s.cache.Load(hash); ok {
+				emb = v.([]float32)
+				hits.Add(1)
+			}
+		}
+
+		meta := event.Metadata
+
+		if meta == nil {
+			meta = cef(event.Content)
+		}
+
+		if s.cfg.MaxEvents > 0 {
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+
+			meta["ingested"] = strconv.FormatInt(time.Now().UnixNano(), 10) // order
+		}
+
+		s.learn(meta)
+		s.note(event.Case, meta)
+
+		docs[event.Case] = append(docs[event.Case], chromem.Document{
+			ID:        id,
+			Metadata:  meta,
+			Content:   event.Content,
+			Embedding: emb,
+		})
+	}
+
+	return docs, nil
+}
+
+// store adds the embedded documents, to the new collection if it was
+// recreated meanwhile.
+func (s *Server) store(ctx context.Context, name string, docs []chromem.Document) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	col, err := s.open(name)
+
+	if err != nil {
+		return err
+	}
+
+	err = col.AddDocuments(ctx, docs, runtime.NumCPU())
+
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		s.ledger(name).push(doc.ID)
+	}
+
+	return nil
+}
+
+// vectors embeds the documents without an embedding and reports which.
+func vectors(ctx context.Context, embed chromem.EmbeddingFunc, docs []chromem.Document) ([]bool, error) {
+	var wg sync.WaitGroup
+
+	fresh := make([]bool, len(docs))
+	errs := make([]error, len(docs))
+	slots := make(chan struct{}, runtime.NumCPU())
+
+	for i := range docs {
+		if len(docs[i].Embedding) > 0 {
+			continue
+		}
+
+		fresh[i] = true
+
+		wg.Go(func() {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			docs[i].Embedding, errs[i] = embed(ctx, docs[i].Content)
+		})
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fresh, nil
+}
+
+func between(res []chromem.Result, from, to *time.Time) []chromem.Result {
+	if from == nil && to == nil {
+		return res
+	}
+
+	return slices.DeleteFunc(res, func(r chromem.Result) bool {
+		t, ok := timestamp(r.Metadata)
+
+		switch {
+		case !ok:
+			return true // unknown time
+		case from != nil && t.Before(*from):
+			return true
+		case to != nil && t.After(*to):
+			return true
+		}
+
+		return false
+	})
+}
+
+func (s *Server) learn(meta map[string]string) {
+	for k := range meta {
+		s.keys.Store(k, true)
+	}
+}
+
+// note remembers the formats ingested into a collection.
+func (s *Server) note(name string, meta map[string]string) {
+	if f, ok := meta["format"]; ok {
+		s.formats.Store(name+"/"+f, true)
+	}
+}
+
+// scan reads the events from an export of the database, which bypasses the
+// collection's lock and is only safe before the workers start.
+func (s *Server) scan(name string) ([]chromem.Document, error) {
+	var export struct {
+		Collections map[string]*struct {
+			Documents map[string]*chromem.Document
+		}
+	}
+
+	r, w := io.Pipe()
+	defer r.Close()
+
+	go func() {
+		w.CloseWithError(s.db.ExportToWriter(w, false, "", name))
+	}()
+
+	err := gob.NewDecoder(r).Decode(&export)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []chromem.Document
+
+	if col, ok := export.Collections[name]; ok {
+		for _, doc := range col.Documents {
+			docs = append(docs, *doc)
+		}
+	}
+
+	// events ingested before the cap have no order and go first
+	slices.SortFunc(docs, func(a, b chromem.Document) int {
+		x, _ := strconv.ParseInt(a.Metadata["ingested"], 10, 64)
+		y, _ := strconv.ParseInt(b.Metadata["ingested"], 10, 64)
+
+		return cmp.Or(cmp.Compare(x, y), strings.Compare(a.ID, b.ID))
+	})
+
+	return docs, nil
+}
+
+func (s *Server) ledger(name string) *ledger {
+	if v, ok := s.ledgers.Load(name); ok {
+		return v.(*ledger)
+	}
+
+	v, _ := s.ledgers.LoadOrStore(name, newLedger())
+
+	return v.(*ledger)
+}
+
+// each calls fn with the events of the collection in ingest order, events
+// deleted meanwhile are skipped.
+func (s *Server) each(ctx context.Context, name string, fn func(chromem.Document) error) error {
+	v, ok := s.collections.Load(name)
+
+	if !ok {
+		return nil
+	}
+
+	col := v.(*chromem.Collection)
+
+	for _, id := range s.ledger(name).ids() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		doc, err := col.GetByID(ctx, id) // copy under the collection's lock
+
+		if err != nil {
+			continue // deleted meanwhile
+		}
+
+		if err = fn(doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) documents(ctx context.Context, name string) ([]chromem.Document, error) {
+	var docs []chromem.Document
+
+	err := s.each(ctx, name, func(doc chromem.Document) error {
+		docs = append(docs, doc)
+		return nil
+	})
+
+	return docs, err
+}
+
+func (s *Server) reembed(ctx context.Context, docs []chromem.Document) error {
+	for i := range docs {
+		err := s.retry(ctx, func() (err error) {
+			docs[i].Embedding, err = s.embed(ctx, docs[i].Content)
+			return
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if (i+1)%1000 == 0 {
+			logs(ctx).Info("reindex", "events", i+1, "total", len(docs))
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) reindex(ctx context.Context, name string) (int, error) {
+	docs, err := s.documents(ctx, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.reembed(ctx, docs)
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the events are replaced in place, a cancellation must not stop halfway
+	ctx = context.WithoutCancel(ctx)
+
+	col := s.get(name)
+
+	if col == nil {
+		return 0, nil // deleted meanwhile
+	}
+
+	all, err := s.documents(ctx, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	embedded := make(map[string]chromem.Document, len(docs))
+
+	for _, doc := range docs {
+		embedded[doc.ID] = doc
+	}
+
+	docs = make([]chromem.Document, 0, len(all))
+
+	var delta []chromem.Document
+
+	for _, doc := range all {
+		if e, ok := embedded[doc.ID]; ok && e.Content == doc.Content {
+			doc.Embedding = e.Embedding
+			docs = append(docs, doc)
+		} else {
+			delta = append(delta, doc) // ingested or changed meanwhile
+		}
+	}
+
+	err = s.reembed(ctx, delta)
+
+	if err != nil {
+		return 0, err
+	}
+
+	docs = append(docs, delta...)
+
+	if len(docs) > 0 {
+		err = col.AddDocuments(ctx, docs, runtime.NumCPU()) // replaces by id
+	}
+
+	return len(docs), err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInsertDuplicate(t *testing.T) {
+	s := server(t, config(), &fake{})
+
+	event := Event{Case: Collection, Content: "CEF:0|Fox|Test|1.0|100|login failed|5|src=10.0.0.1"}
+
+	n, err := s.insert(context.Background(), s.embed, []Event{event, event}) // same batch
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := s.add(context.Background(), event) // later batch
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 || ok {
+		t.Errorf("expected 1 insert, got %d and %v", n, ok)
+	}
+
+	if count := s.get(Collection).Count(); count != 1 {
+		t.Errorf("expected count 1, got %d", count)
+	}
+}
+
+func TestIngestWorkers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+
+	const lines = 10000
+
+	var body strings.Builder
+
+	for i := range lines {
+		fmt.Fprintf(&body, "CEF:0|Fox|Test|1.0|%d|event %d|5|\n", i, i)
+	}
+
+	ingest := func(workers int) time.Duration {
+		cfg := config()
+
+		cfg.Buffer = lines
+		cfg.Workers = workers
+
+		s := server(t, cfg, &fake{delay: 100 * time.Microsecond})
+
+		start := time.Now()
+
+		n, _, err := s.enqueue(context.Background(), Collection, "cef", body.String())
+
+		if err != nil || n != lines {
+			t.Fatalf("enqueued %d events: %v", n, err)
+		}
+
+		for s.ingested.Load() < lines {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return time.Since(start)
+	}
+
+	one, four := ingest(1), ingest(4)
+
+	t.Logf("%d events: 1 worker %v, 4 workers %v, speedup %.1fx", lines, one, four, one.Seconds()/four.Seconds())
+
+	if four > one*2/3 {
+		t.Errorf("expected a speedup with 4 workers, got %v vs %v", four, one)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+var severities = []string{
+	"emerg",
+	"alert",
+	"crit",
+	"err",
+	"warning",
+	"notice",
+	"info",
+	"debug",
+}
+
+var fields = []string{
+	"timestamp",
+	"host",
+	"app",
+	"procid",
+	"msgid",
+}
+
+func syslog(line string) (map[string]string, string) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "<")
+
+	if !ok {
+		return nil, "" // malformed
+	}
+
+	i := strings.IndexByte(rest, '>')
+
+	if i < 1 || i > 3 {
+		return nil, "" // malformed
+	}
+
+	pri, err := strconv.Atoi(rest[:i])
+
+	if err != nil || pri > 191 {
+		return nil, "" // malformed
+	}
+
+	version, rest, ok := strings.Cut(rest[i+1:], " ")
+
+	if !ok || version != "1" {
+		return nil, "" // malformed
+	}
+
+	meta := map[string]string{
+		"format":   "syslog",
+		"facility": strconv.Itoa(pri / 8),
+		"severity": severities[pri%8],
+	}
+
+	for _, key := range fields {
+		var v string
+
+		v, rest, ok = strings.Cut(rest, " ")
+
+		if !ok && key != fields[len(fields)-1] {
+			return nil, "" // malformed
+		}
+
+		if v != "-" {
+			meta[key] = v
+		}
+	}
+
+	rest, ok = data(rest, meta)
+
+	if !ok {
+		return nil, "" // malformed
+	}
+
+	msg := strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+
+	return meta, msg
+}
+
+func data(s string, meta map[string]string) (string, bool) {
+	if s == "-" || strings.HasPrefix(s, "- ") || len(s) == 0 {
+		return strings.TrimPrefix(s, "-"), true
+	}
+
+	for strings.HasPrefix(s, "[") {
+		end := -1
+		quoted := false
+
+		for i := 1; i < len(s) && end < 0; i++ {
+			switch {
+			case s[i] == '\\' && quoted:
+				i++ // escaped
+			case s[i] == '"':
+				quoted = !quoted
+			case s[i] == ']' && !quoted:
+				end = i
+			}
+		}
+
+		if end < 0 {
+			return "", false
+		}
+
+		params(s[1:end], meta)
+
+		s = s[end+1:]
+	}
+
+	return s, true
+}
+
+func params(s string, meta map[string]string) {
+	id, s, _ := strings.Cut(s, " ")
+
+	for len(s) > 0 {
+		k, v, ok := strings.Cut(s, `="`)
+
+		if !ok {
+			return
+		}
+
+		var val strings.Builder
+
+		i := 0
+
+		for ; i < len(v) && v[i] != '"'; i++ {
+			if v[i] == '\\' && i+1 < len(v) {
+				i++ // escaped
+			}
+
+			val.WriteByte(v[i])
+		}
+
+		meta[id+"."+strings.TrimSpace(k)] = val.String()
+
+		s = strings.TrimSpace(v[min(i+1, len(v)):])
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestSyslog(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		meta map[string]string
+		msg  string
+	}{
+		{ // rfc 5424 example 1
+			"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \ufeff'su root' failed for lonvick on /dev/pts/8",
+			map[string]string{"format": "syslog", "facility": "4", "severity": "crit", "timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine.example.com", "app": "su", "msgid": "ID47"},
+			"'su root' failed for lonvick on /dev/pts/8",
+		},
+		{ // rfc 5424 example 3
+			`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] An application event log entry`,
+			map[string]string{"format": "syslog", "facility": "20", "severity": "notice", "timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine.example.com", "app": "evntslog", "msgid": "ID47", "exampleSDID@32473.iut": "3", "exampleSDID@32473.eventSource": "Application", "exampleSDID@32473.eventID": "1011"},
+			"An application event log entry",
+		},
+		{ // rfc 5424 example 4, without msg
+			`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3"][examplePriority@32473 class="high"]`,
+			map[string]string{"format": "syslog", "facility": "20", "severity": "notice", "timestamp": "2003-10-11T22:14:15.003Z", "host": "mymachine.example.com", "app": "evntslog", "msgid": "ID47", "exampleSDID@32473.iut": "3", "examplePriority@32473.class": "high"},
+			"",
+		},
+		{ // escaped quotes, brackets and backslashes
+			`<13>1 - host app 42 - [x@1 msg="say \"hi\" ]" path="C:\\tmp"] done`,
+			map[string]string{"format": "syslog", "facility": "1", "severity": "notice", "host": "host", "app": "app", "procid": "42", "x@1.msg": `say "hi" ]`, "x@1.path": `C:\tmp`},
+			"done",
+		},
+		{ // without structured data and msg
+			"<0>1 - - - - - -",
+			map[string]string{"format": "syslog", "facility": "0", "severity": "emerg"},
+			"",
+		},
+		{"no syslog", nil, ""},
+		{"<192>1 - - - - - - msg", nil, ""},         // priority
+		{"<13> Oct 11 22:14:15 host msg", nil, ""},  // bsd syslog
+		{`<13>1 - - - - - [x@1 a="b] msg`, nil, ""}, // unterminated
+	} {
+		meta, msg := syslog(tc.line)
+
+		if !maps.Equal(meta, tc.meta) || msg != tc.msg {
+			t.Errorf("%s:\ngot  %v %q\nwant %v %q", tc.line, meta, msg, tc.meta, tc.msg)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"time"
+)
+
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type Failure struct {
+	Error Error `json:"error"`
+}
+
+type Event struct {
+	Case      string
+	ID        string
+	Content   string
+	Metadata  map[string]string
+	Embedding []float32
+}
+
+type Count struct {
+	Count      int    `json:"count"`
+	Collection string `json:"collection"`
+}
+
+type Version struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Model   string `json:"model"`
+	Embed   string `json:"embed"`
+}
+
+type Stats struct {
+	Ingested   int64   `json:"ingested"`
+	Count      int     `json:"count"`
+	Collection string  `json:"collection"`
+	Queries    int64   `json:"queries"`
+	Average    float64 `json:"latency_avg_ms"`
+	P95        float64 `json:"latency_p95_ms"`
+	Uptime     string  `json:"uptime"`
+}
+
+type Status struct {
+	Queued   int   `json:"queued"`
+	Indexed  int64 `json:"indexed"`
+	Inflight bool  `json:"inflight"`
+}
+
+type Chunk struct {
+	Type    string   `json:"type"`
+	Content string   `json:"content,omitempty"`
+	Sources []Source `json:"sources,omitempty"`
+	Error   *Error   `json:"error,omitempty"`
+}
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type Page struct {
+	Results []Source `json:"results"`
+	Total   int      `json:"total"`
+	Offset  int      `json:"offset"`
+}
+
+type Record struct {
+	ID        string            `json:"id"`
+	Content   string            `json:"content"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Embedding []float32         `json:"embedding,omitempty"`
+}
+
+type Import struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+type Upload struct {
+	File     string `json:"file"`
+	Events   int    `json:"events"`
+	Rejected int    `json:"rejected"`
+}
+
+type Snapshot struct {
+	File   string `json:"file"`
+	Events int    `json:"events"`
+}
+
+type Purge struct {
+	Deleted int      `json:"deleted"`
+	Missing []string `json:"missing"`
+}
+
+type Neighbor struct {
+	ID         string  `json:"id"`
+	Similarity float32 `json:"similarity"`
+}
+
+type Source struct {
+	ID         string  `json:"id"`
+	Content    string  `json:"content"`
+	Similarity float32 `json:"similarity"`
+}
+
+type Question struct {
+	Query       string            `json:"query"`
+	System      string            `json:"system"`
+	Model       string            `json:"model"`
+	Case        string            `json:"case"`
+	Where       map[string]string `json:"where"`
+	From        *time.Time        `json:"from"`
+	To          *time.Time        `json:"to"`
+	Timeout     *Timeout          `json:"timeout"`
+	Debug       bool              `json:"debug"`
+	Stateless   bool              `json:"stateless"`
+	Mode        string            `json:"mode"`
+	TopK        int               `json:"topk"`
+	Temperature *float64          `json:"temperature"`
+	Seed        *int              `json:"seed"`
+	SampleTopK  *int              `json:"top_k"`
+	SampleTopP  *float64          `json:"top_p"`
+	N           int               `json:"n"`
+	NumCtx      int               `json:"num_ctx"`
+	NumPredict  int               `json:"num_predict"`
+}
+
+// Timeout is given in seconds or as a duration string, unlike api.Duration
+// it keeps negative values.
+type Timeout struct {
+	time.Duration
+}
+
+type Frame struct {
+	Question string
+	Context  string
+}
+
+type Debug struct {
+	Context   string `json:"context"`
+	Prompt    string `json:"prompt"`
+	Collapsed int    `json:"collapsed"`
+}
+
+type Usage struct {
+	Prompt     int `json:"prompt_tokens"`
+	Completion int `json:"completion_tokens"`
+}
+
+type Answer struct {
+	Answer  string   `json:"answer"`
+	Answers []string `json:"answers,omitempty"`
+	Sources []Source `json:"sources"`
+	Usage   *Usage   `json:"usage,omitempty"`
+	Debug   *Debug   `json:"debug,omitempty"`
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// chat answers the questions of a websocket connection, the conversation
+// is kept per connection and the llm call canceled on disconnect.
+func (s *Server) chat(c *gin.Context) {
+	up := websocket.Upgrader{
+		CheckOrigin: s.origin,
+	}
+
+	conn, err := up.Upgrade(c.Writer, c.Request, nil)
+
+	if err != nil {
+		return // already replied
+	}
+
+	defer conn.Close()
+
+	conn.SetReadLimit(s.cfg.MaxBody) // the body limit does not cover frames
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	session := "ws/" + uuid.NewString()
+	defer s.reset(session)
+
+	var mu sync.Mutex
+	var busy atomic.Bool
+
+	send := func(ch Chunk) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		_ = conn.WriteJSON(ch) // read fails too
+	}
+
+	fail := func(code int, err error) {
+		e := envelope(c, code, err).Error
+
+		send(Chunk{
+			Type:  "error",
+			Error: &e,
+		})
+	}
+
+	questions := make(chan []byte)
+
+	go func() {
+		defer close(questions)
+		defer cancel() // disconnect
+
+		for {
+			_, msg, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			if !busy.CompareAndSwap(false, true) {
+				fail(http.StatusTooManyRequests, errors.New("a question is already being answered"))
+				continue
+			}
+
+			questions <- msg
+		}
+	}()
+
+	for msg := range questions {
+		q, err := s.frame(c, msg)
+
+		if err != nil {
+			fail(http.StatusBadRequest, err)
+			busy.Store(false)
+			continue
+		}
+
+		start := time.Now()
+
+		answer, err := s.query(ctx, session, q, func(chunk string) {
+			if len(chunk) == 0 {
+				return // final
+			}
+
+			send(Chunk{
+				Type:    "token",
+				Content: chunk,
+			})
+		})
+
+		if err != nil {
+			fail(status(err), err)
+			busy.Store(false)
+			continue
+		}
+
+		s.observe(time.Since(start))
+
+		send(Chunk{
+			Type:    "done",
+			Sources: answer.Sources,
+		})
+
+		busy.Store(false)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// frame parses a question given as text or as json object.
+func (s *Server) frame(c *gin.Context, msg []byte) (Question, error) {
+	q := s.defaults(c)
+
+	q.Query = string(msg)
+
+	if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		q.Query = ""
+
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&q)
+
+		if err != nil {
+			return q, err
+		}
+
+		if len(q.Case) == 0 {
+			q.Case = s.cfg.Collection
+		}
+	}
+
+	if q.N > 1 {
+		return q, errors.New("multiple answers can not be streamed")
+	}
+
+	return q, s.validate(q)
+}
+
+func (s *Server) origin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if len(origin) == 0 || slices.Contains(s.cfg.Origins, origin) || slices.Contains(s.cfg.Origins, "*") {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+
+	return err == nil && u.Host == r.Host // same origin
+}